@@ -0,0 +1,230 @@
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+// childTable is a list property stored in a child table with the columns parent_id, value and
+// ordinal, one row per list item. parent_id holds the key of the parent row, with the type of
+// the parent's key column.
+type childTable struct {
+	property  string
+	name      string
+	table     string
+	mapping   *cdl.EntityToItemPropertyMapping
+	reference bool
+}
+
+// childTableName returns the child_table set in the custom settings of a property mapping.
+func childTableName(custom map[string]any) string {
+	name, _ := custom["child_table"].(string)
+	return name
+}
+
+// incomingChildTables returns the child tables of the incoming mapping of a dataset.
+func incomingChildTables(dsd *cdl.DatasetDefinition, schema string) []childTable {
+	var children []childTable
+	if dsd.IncomingMappingConfig == nil {
+		return nil
+	}
+	for _, pm := range dsd.IncomingMappingConfig.PropertyMappings {
+		if name := childTableName(pm.Custom); name != "" {
+			children = append(children, childTable{property: pm.Property, name: name, table: quoteTable(schema, name), mapping: pm, reference: pm.IsReference})
+		}
+	}
+	return children
+}
+
+// outgoingChildTables returns the child tables of the outgoing mapping of a dataset.
+func outgoingChildTables(dsd *cdl.DatasetDefinition, schema string) []childTable {
+	var children []childTable
+	if dsd.OutgoingMappingConfig == nil {
+		return nil
+	}
+	for _, pm := range dsd.OutgoingMappingConfig.PropertyMappings {
+		if name := childTableName(pm.Custom); name != "" {
+			children = append(children, childTable{property: pm.Property, name: name, table: quoteTable(schema, name), reference: pm.IsReference})
+		}
+	}
+	return children
+}
+
+// extractChildren removes the child table properties from a mapped row and returns their
+// converted list items by property.
+func (o *MysqlWriter) extractChildren(item *RowItem) (map[string][]any, error) {
+	if len(o.children) == 0 {
+		return nil, nil
+	}
+	children := make(map[string][]any, len(o.children))
+	for _, child := range o.children {
+		var values []any
+		for i, col := range item.Columns {
+			if col != child.property {
+				continue
+			}
+			switch v := item.Values[i].(type) {
+			case nil:
+			case []any:
+				values = append([]any(nil), v...)
+			case []string:
+				for _, s := range v {
+					values = append(values, s)
+				}
+			default:
+				values = []any{v}
+			}
+			item.Columns = append(item.Columns[:i:i], item.Columns[i+1:]...)
+			item.Values = append(item.Values[:i:i], item.Values[i+1:]...)
+			delete(item.Map, col)
+			break
+		}
+		for i, v := range values {
+			converted, err := convertValue(v, child.mapping)
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %w", child.property, err)
+			}
+			values[i] = converted
+		}
+		children[child.property] = values
+	}
+	return children, nil
+}
+
+// childSize estimates the bytes the child rows of an entity add to the batch.
+func childSize(children map[string][]any) int {
+	size := 0
+	for _, values := range children {
+		for _, v := range values {
+			size += argSize(v) + 64
+		}
+	}
+	return size
+}
+
+// childDeleteStatements builds the statements removing the child rows of the given keys, so
+// they can be replaced together with their parents.
+func (o *MysqlWriter) childDeleteStatements(keys []rowKey) []statement {
+	var statements []statement
+	for _, child := range o.children {
+		for _, chunk := range o.chunkKeys(keys) {
+			var sb strings.Builder
+			sb.WriteString("DELETE FROM ")
+			sb.WriteString(child.table)
+			sb.WriteString(" WHERE `parent_id` IN (")
+			args := make([]any, 0, len(chunk))
+			for i, key := range chunk {
+				if i > 0 {
+					sb.WriteString(", ")
+				}
+				sb.WriteString("?")
+				args = append(args, key.values[0])
+			}
+			sb.WriteString(")")
+			statements = append(statements, statement{stmt: sb.String(), args: args})
+		}
+	}
+	return statements
+}
+
+// childInsertStatements builds the statements inserting the child rows of the given parent
+// rows. They run right after the insert of the parents, so only rows that were inserted get
+// their children.
+func (o *MysqlWriter) childInsertStatements(rows []EntityInsert) []statement {
+	var statements []statement
+	for _, child := range o.children {
+		var sb strings.Builder
+		var args []any
+		size := 0
+		emit := func() {
+			if len(args) > 0 {
+				statements = append(statements, statement{stmt: sb.String(), args: args})
+			}
+			sb.Reset()
+			args = nil
+			size = 0
+		}
+		for _, row := range rows {
+			parent := row.Key.values[0]
+			for ordinal, value := range row.Children[child.property] {
+				rs := argSize(parent) + argSize(value) + 64
+				if len(args) > 0 && o.statementLimit > 0 && size+rs > o.statementLimit {
+					emit()
+				}
+				if len(args) == 0 {
+					sb.WriteString("INSERT INTO ")
+					sb.WriteString(child.table)
+					sb.WriteString(" (`parent_id`, `value`, `ordinal`) VALUES ")
+				} else {
+					sb.WriteString(", ")
+				}
+				sb.WriteString("(?, ?, ?)")
+				args = append(args, parent, value, ordinal)
+				size += rs
+			}
+		}
+		emit()
+	}
+	return statements
+}
+
+// childColumn returns the select expression aggregating the child rows of a list property as
+// a json array of [ordinal, value] pairs. parentKey is the quoted key column of the parent.
+func childColumn(child childTable, parentKey string) string {
+	return "(SELECT JSON_ARRAYAGG(JSON_ARRAY(`c`.`ordinal`, `c`.`value`)) FROM " + child.table +
+		" AS `c` WHERE `c`.`parent_id` = " + parentKey + ") AS " + quoteIdentifier(child.property)
+}
+
+// childValues decodes an aggregated child column into the list items in ordinal order.
+// References are returned as strings, as the mapper expects them.
+func childValues(data []byte, reference bool) (any, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var pairs [][2]any
+	if err := decoder.Decode(&pairs); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return lessValue(pairs[i][0], pairs[j][0])
+	})
+	if reference {
+		values := make([]string, len(pairs))
+		for i, pair := range pairs {
+			values[i] = fmt.Sprintf("%v", jsonValue(pair[1]))
+		}
+		return values, nil
+	}
+	values := make([]any, len(pairs))
+	for i, pair := range pairs {
+		values[i] = jsonValue(pair[1])
+	}
+	return values, nil
+}
+
+// readKeyColumn returns the key column of the parent table for reading child tables: a single
+// key_columns entry, or the identity column of the outgoing mapping.
+func readKeyColumn(dsd *cdl.DatasetDefinition) (string, error) {
+	if list, ok := dsd.SourceConfig[KeyColumns].([]any); ok {
+		if len(list) != 1 {
+			return "", fmt.Errorf("child tables need a single key column")
+		}
+		name, _ := list[0].(string)
+		return name, nil
+	}
+	if dsd.OutgoingMappingConfig != nil {
+		for _, pm := range dsd.OutgoingMappingConfig.PropertyMappings {
+			if pm.IsIdentity {
+				return pm.Property, nil
+			}
+		}
+	}
+	return "id", nil
+}
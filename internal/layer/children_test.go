@@ -0,0 +1,169 @@
+package layer
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func newChildTestWriter() *MysqlWriter {
+	w := newTestWriter()
+	tags := &common.EntityToItemPropertyMapping{Property: "tags", Custom: map[string]any{"child_table": "product_tag"}}
+	w.propertyMappings = append(w.propertyMappings, tags)
+	w.children = []childTable{{property: "tags", name: "product_tag", table: "`product_tag`", mapping: tags}}
+	return w
+}
+
+func TestChildTables(t *testing.T) {
+	t.Run("Should move list properties out of the parent row", func(t *testing.T) {
+		w := newChildTestWriter()
+		tags := []any{"a", "b"}
+		row := testRow([]string{"id", "tags"}, []any{"1", tags})
+		children, err := w.extractChildren(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row.Columns, []string{"id"}) || len(row.Values) != 1 {
+			t.Fatalf("Expected the list to be removed from the row, got %v", row.Columns)
+		}
+		if !reflect.DeepEqual(children["tags"], []any{"a", "b"}) {
+			t.Fatalf("Unexpected children %v", children)
+		}
+		children["tags"][0] = "changed"
+		if tags[0] != "a" {
+			t.Fatalf("Expected the entity's list to be left unchanged")
+		}
+	})
+
+	t.Run("Should replace child rows of the batched parents", func(t *testing.T) {
+		w := newChildTestWriter()
+		one, two := newRowKey([]any{int64(1)}), newRowKey([]any{int64(2)})
+		w.batchInserts["1"] = EntityInsert{Id: "1", Key: one, RowItem: testRow([]string{"id"}, []any{int64(1)}), Children: map[string][]any{"tags": {"a", "b"}}}
+		w.batchInserts["2"] = EntityInsert{Id: "2", Key: two, RowItem: testRow([]string{"id"}, []any{int64(2)}), Children: map[string][]any{"tags": {"c"}}}
+
+		deletes := w.childDeleteStatements([]rowKey{one, two})
+		if len(deletes) != 1 || deletes[0].stmt != "DELETE FROM `product_tag` WHERE `parent_id` IN (?, ?)" {
+			t.Fatalf("Unexpected deletes %v", deletes)
+		}
+		if !reflect.DeepEqual(deletes[0].args, []any{int64(1), int64(2)}) {
+			t.Fatalf("Expected the converted key values, got %v", deletes[0].args)
+		}
+	})
+
+	t.Run("Should insert child rows together with their parents", func(t *testing.T) {
+		w := newChildTestWriter()
+		w.batchInserts["1"] = EntityInsert{Id: "1", Key: newRowKey([]any{"1"}), RowItem: testRow([]string{"id"}, []any{"1"}), Children: map[string][]any{"tags": {"a", "b"}}}
+		w.batchInserts["2"] = EntityInsert{Id: "2", Key: newRowKey([]any{"2"}), RowItem: testRow([]string{"id"}, []any{"2"}), Children: map[string][]any{"tags": {"c"}}}
+
+		statements := w.insertStatements(map[string]bool{"2": true})
+		if len(statements) != 1 || len(statements[0].children) != 1 {
+			t.Fatalf("Expected one insert with its child rows, got %v", statements)
+		}
+		inserts := statements[0].children
+		if inserts[0].stmt != "INSERT INTO `product_tag` (`parent_id`, `value`, `ordinal`) VALUES (?, ?, ?), (?, ?, ?)" {
+			t.Fatalf("Unexpected inserts %v", inserts)
+		}
+		if !reflect.DeepEqual(inserts[0].args, []any{"1", "a", 0, "1", "b", 1}) {
+			t.Fatalf("Unexpected args %v", inserts[0].args)
+		}
+
+		// a part of a failed batch brings the child rows of exactly its own rows
+		part := w.insertStatement([]EntityInsert{w.batchInserts["2"]})
+		if len(part.children) != 1 || !reflect.DeepEqual(part.children[0].args, []any{"2", "c", 0}) {
+			t.Fatalf("Unexpected child rows %v", part.children)
+		}
+	})
+
+	t.Run("Should type parent_id like the parent's key column", func(t *testing.T) {
+		stmt, err := createChildTableStatement(childTable{property: "tags", table: "`product_tag`"}, "BIGINT")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stmt != "CREATE TABLE IF NOT EXISTS `product_tag` (`parent_id` BIGINT NOT NULL, `ordinal` INT NOT NULL, `value` TEXT, PRIMARY KEY (`parent_id`, `ordinal`))" {
+			t.Fatalf("Unexpected statement %s", stmt)
+		}
+	})
+
+	t.Run("Should decode aggregated child rows in ordinal order", func(t *testing.T) {
+		values, err := childValues([]byte(`[[1, "b"], [0, "a"]]`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, []any{"a", "b"}) {
+			t.Fatalf("Unexpected values %v", values)
+		}
+		values, err = childValues([]byte(`[[0, "http://data.test/1"]]`), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, []string{"http://data.test/1"}) {
+			t.Fatalf("Expected references as strings, got %v", values)
+		}
+		if values, _ := childValues(nil, false); values != nil {
+			t.Fatalf("Expected no values for a parent without children, got %v", values)
+		}
+	})
+
+	t.Run("Should round-trip large integer ids through a child table", func(t *testing.T) {
+		w := newChildTestWriter()
+		w.children[0].mapping.Datatype = "long"
+		ids := []any{int64(12345678), int64(9007199254740993)}
+		row := testRow([]string{"id", "tags"}, []any{"1", ids})
+		children, err := w.extractChildren(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.batchInserts["1"] = EntityInsert{Id: "1", Key: newRowKey([]any{"1"}), RowItem: row, Children: children}
+		args := w.insertStatements(nil)[0].children[0].args
+
+		// aggregate the inserted rows the way JSON_ARRAYAGG returns them
+		var pairs [][2]any
+		for i := 0; i < len(args); i += 3 {
+			pairs = append(pairs, [2]any{args[i+2], args[i+1]})
+		}
+		data, err := json.Marshal(pairs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := childValues(data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, ids) {
+			t.Fatalf("Expected %v, got %v", ids, values)
+		}
+		references, err := childValues(data, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(references, []string{"12345678", "9007199254740993"}) {
+			t.Fatalf("Expected the ids in full, got %v", references)
+		}
+	})
+
+	t.Run("Should aggregate child tables when reading", func(t *testing.T) {
+		definition := &common.DatasetDefinition{
+			SourceConfig: map[string]any{TableName: "product"},
+			OutgoingMappingConfig: &common.OutgoingMappingConfig{
+				PropertyMappings: []*common.ItemToEntityPropertyMapping{
+					{Property: "id", IsIdentity: true},
+					{Property: "tags", Custom: map[string]any{"child_table": "product_tag"}},
+				},
+			},
+		}
+		q, err := buildQuery(definition, "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "SELECT `id`, (SELECT JSON_ARRAYAGG(JSON_ARRAY(`c`.`ordinal`, `c`.`value`)) FROM `product_tag` AS `c` WHERE `c`.`parent_id` = `product`.`id`) AS `tags` FROM `product`"
+		if q != expected {
+			t.Fatalf("Unexpected query:\n%s\nexpected:\n%s", q, expected)
+		}
+		definition.SourceConfig[DataQuery] = "SELECT * FROM product"
+		if _, err := buildQuery(definition, "", "", "", 0); err == nil {
+			t.Fatalf("Expected an error for child tables with a data query")
+		}
+	})
+}
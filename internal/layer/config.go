@@ -1,31 +1,80 @@
 package layer
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	cdl "github.com/mimiro-io/common-datalayer"
+	"net"
+	"reflect"
+	"sort"
 	"strings"
 )
 
 const (
 	// dataset mapping config
-	TableName      = "table_name"
-	FlushThreshold = "flush_threshold"
-	AppendMode     = "append_mode"
-	SinceColumn    = "since_column"
-	SincePrecision = "since_precision"
-	EntityColumn   = "entity_column"
-	SinceTable     = "since_table"
-	DataQuery      = "data_query"
+	TableName        = "table_name"
+	FlushThreshold   = "flush_threshold"
+	FlushBytes       = "flush_bytes"
+	AppendMode       = "append_mode"
+	SinceColumn      = "since_column"
+	SincePrecision   = "since_precision"
+	EntityColumn     = "entity_column"
+	SinceTable       = "since_table"
+	DataQuery        = "data_query"
+	AutoCreateTable  = "auto_create_table"
+	AutoMigrate      = "auto_migrate"
+	ColumnCase       = "column_case"
+	TransactionScope = "transaction_scope"
+	RetryAttempts    = "retry_attempts"
+	RetryBackoff     = "retry_backoff"
+	DeadLetterTable  = "dead_letter_table"
+	RecordedColumn   = "recorded_column"
+	SchemaCheck      = "schema_check"
+	KeyColumns       = "key_columns"
+	IdentityPattern  = "identity_pattern"
+	Routes           = "routes"
+	Joins            = "joins"
+	ForeignKeyRefs   = "foreign_key_references"
+)
+
+const (
+	// transaction_scope values
+	TransactionScopeRequest = "request"
+	TransactionScopeFlush   = "flush"
+	TransactionScopeNone    = "none"
+)
+
+const (
+	// schema_check values
+	SchemaCheckOff  = "off"
+	SchemaCheckWarn = "warn"
+	SchemaCheckFail = "fail"
+)
+
+const (
+	// column_case values
+	ColumnCasePreserve = "preserve"
+	ColumnCaseLower    = "lower"
 )
 
 type MysqlConf struct {
 	Hostname string `json:"host"`
 	Port     string `json:"port"`
-	Database string `json:"database"`
-	User     string `json:"user"`
-	Password string `json:"password"`
-	Schema   string `json:"schema"`
+	// ordered list of "host" or "host:port" entries to fail over between, takes precedence over host
+	Hosts hostList `json:"hosts"`
+	// path to a unix socket, takes precedence over host and hosts
+	Socket       string `json:"socket"`
+	Database     string `json:"database"`
+	User         string `json:"user"`
+	Password     string `json:"password"`
+	UserFile     string `json:"user_file"`
+	PasswordFile string `json:"password_file"`
+	Schema       string `json:"schema"`
+	// optional port for the deep health endpoint
+	HealthPort string `json:"health_port"`
+	// how often user_file and password_file are checked for rotated credentials, e.g. "30s"
+	CredentialsRefreshInterval string `json:"credentials_refresh_interval"`
 }
 
 func newMysqlConf(config *cdl.Config) (*MysqlConf, cdl.LayerError) {
@@ -38,59 +87,233 @@ func newMysqlConf(config *cdl.Config) (*MysqlConf, cdl.LayerError) {
 		return nil, cdl.Err(fmt.Errorf("could not unmarshal native system config because %s", err.Error()), cdl.LayerErrorInternal)
 	}
 
+	err = c.loadCredentialFiles()
+	if err != nil {
+		return nil, cdl.Err(err, cdl.LayerErrorInternal)
+	}
+
 	return c, nil
 }
 
-func (dl *MysqlDatalayer) UpdateConfiguration(config *cdl.Config) cdl.LayerError {
-	// close connection and create new one
-	err := dl.db.db.Close()
-	if err != nil {
-		return cdl.Err(fmt.Errorf("could not close database connection because %s", err.Error()), cdl.LayerErrorInternal)
+// columnCase returns the configured column_case of a dataset, defaulting to preserve.
+func columnCase(dsd *cdl.DatasetDefinition) string {
+	if getConfigProperty(dsd.SourceConfig, ColumnCase) == ColumnCaseLower {
+		return ColumnCaseLower
 	}
+	return ColumnCasePreserve
+}
 
-	// update database connection
-	dl.db, err = newMysqlDB(config)
-	if err != nil {
-		return cdl.Err(fmt.Errorf("could not create new database connection because %s", err.Error()), cdl.LayerErrorInternal)
-	}
-	existingDatasets := map[string]bool{}
-	// update existing datasets
-	for k, v := range dl.datasets {
-		for _, dsd := range config.DatasetDefinitions {
-			if k == dsd.DatasetName {
-				existingDatasets[k] = true
-				v.datasetDefinition = dsd
-				v.db = dl.db
-			}
+// transactionScope returns the configured transaction_scope of a dataset, defaulting to request.
+func transactionScope(dsd *cdl.DatasetDefinition) string {
+	switch scope := getConfigProperty(dsd.SourceConfig, TransactionScope); scope {
+	case TransactionScopeFlush, TransactionScopeNone:
+		return scope
+	default:
+		return TransactionScopeRequest
+	}
+}
+
+// schemaCheck returns the configured schema_check of a dataset, defaulting to warn.
+func schemaCheck(dsd *cdl.DatasetDefinition) string {
+	switch mode := getConfigProperty(dsd.SourceConfig, SchemaCheck); mode {
+	case SchemaCheckOff, SchemaCheckFail:
+		return mode
+	default:
+		return SchemaCheckWarn
+	}
+}
+
+// applyColumnCase converts a column name according to a column_case mode.
+func applyColumnCase(mode string, column string) string {
+	if mode == ColumnCaseLower {
+		return strings.ToLower(column)
+	}
+	return column
+}
+
+// hostList accepts both a json array and a comma separated string, so hosts can also be set
+// from a single environment variable.
+type hostList []string
+
+func (h *hostList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*h = list
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("hosts must be a list or a comma separated string")
+	}
+	*h = nil
+	for _, host := range strings.Split(str, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			*h = append(*h, host)
 		}
 	}
+	return nil
+}
 
-	// remove deleted datasets
-	for k := range dl.datasets {
-		if _, found := existingDatasets[k]; !found {
-			delete(dl.datasets, k)
+// addresses returns the driver addresses to try, in order. A socket wins over hosts, and hosts
+// win over the single host setting.
+func (c *MysqlConf) addresses() []string {
+	if c.Socket != "" {
+		return []string{"unix(" + c.Socket + ")"}
+	}
+	port := c.Port
+	if port == "" {
+		port = "3306"
+	}
+	hosts := c.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{c.Hostname}
+	}
+	addresses := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, port)
 		}
+		addresses = append(addresses, "tcp("+host+")")
 	}
+	return addresses
+}
 
-	// add new datasets
+// dsn builds the connection string for the go mysql driver for one of the addresses.
+func (c *MysqlConf) dsn(address string) string {
+	return fmt.Sprintf(
+		"%s:%s@%s/%s?parseTime=true&interpolateParams=true",
+		c.User,
+		c.Password,
+		address,
+		c.Database,
+	)
+}
+
+// connectionKey identifies the connection settings. Two configs with the same key can share
+// a connection pool.
+func (c *MysqlConf) connectionKey() string {
+	var key strings.Builder
+	for _, address := range c.addresses() {
+		key.WriteString(c.dsn(address))
+		key.WriteString("\n")
+	}
+	return key.String()
+}
+
+// UpdateConfiguration builds a complete new dataset set for the given config and swaps it in
+// atomically. The connection pool is only recreated when the connection settings changed.
+// If anything fails, the current state keeps running. A replaced pool is closed once the
+// iterators and writers still using it are done.
+func (dl *MysqlDatalayer) UpdateConfiguration(config *cdl.Config) cdl.LayerError {
+	return dl.reload(config, false)
+}
+
+// failover replaces the connection pool with one connected to the next configured host.
+func (dl *MysqlDatalayer) failover() cdl.LayerError {
+	dl.mu.RLock()
+	config := dl.config
+	dl.mu.RUnlock()
+	return dl.reload(config, true)
+}
+
+func (dl *MysqlDatalayer) reload(config *cdl.Config, failover bool) cdl.LayerError {
+	dl.reloadMu.Lock()
+	defer dl.reloadMu.Unlock()
+
+	// reject the whole config before touching anything if a dataset definition is invalid
+	lerr := validateDatasetDefinitions(config.DatasetDefinitions)
+	if lerr != nil {
+		return lerr
+	}
+
+	conf, lerr := newMysqlConf(config)
+	if lerr != nil {
+		return lerr
+	}
+
+	dl.mu.RLock()
+	current := dl.db
+	previous := dl.datasets
+	dl.mu.RUnlock()
+
+	// the health server is started once, with the port of the first configuration
+	if current != nil && conf.HealthPort != current.conf.HealthPort {
+		return cdl.Err(fmt.Errorf("health_port cannot be changed without a restart"), cdl.LayerErrorBadParameter)
+	}
+
+	db := current
+	if db == nil || failover || db.conf.connectionKey() != conf.connectionKey() {
+		skip := ""
+		if failover && current != nil {
+			skip = current.address
+		}
+		var err error
+		db, err = dl.connect(conf, skip)
+		if err != nil {
+			return cdl.Err(fmt.Errorf("could not create new database connection because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+	}
+
+	datasets := make(map[string]*Dataset, len(config.DatasetDefinitions))
 	for _, dsd := range config.DatasetDefinitions {
-		if _, found := existingDatasets[dsd.DatasetName]; !found {
-			dl.datasets[dsd.DatasetName] = &Dataset{
-				logger:            dl.logger,
-				db:                dl.db,
-				datasetDefinition: dsd,
+		// in lower mode, result columns are lowercased, so the mapped column names must be too
+		if columnCase(dsd) == ColumnCaseLower && dsd.OutgoingMappingConfig != nil {
+			for _, pm := range dsd.OutgoingMappingConfig.PropertyMappings {
+				pm.Property = strings.ToLower(pm.Property)
 			}
 		}
+		datasets[dsd.DatasetName] = &Dataset{
+			logger:            dl.logger,
+			db:                db,
+			datasetDefinition: dsd,
+			layer:             dl,
+			metrics:           dl.metrics,
+		}
 	}
 
-	// convert all column names to uppercase
-	for _, ds := range dl.datasets {
-		if ds.datasetDefinition.OutgoingMappingConfig != nil {
-			for _, pm := range ds.datasetDefinition.OutgoingMappingConfig.PropertyMappings {
-				pm.Property = strings.ToLower(pm.Property)
+	// create and migrate tables before the datasets can receive data, then check them
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+	// refreshes, failovers and credential rotations load the same definitions, which need no DDL
+	sameDatabase := current != nil && conf.Database == current.conf.Database && conf.Schema == current.conf.Schema
+	for _, name := range sortedNames(datasets) {
+		if old, found := previous[name]; found && sameDatabase && reflect.DeepEqual(old.datasetDefinition, datasets[name].datasetDefinition) {
+			continue
+		}
+		if err := datasets[name].migrate(ctx); err != nil {
+			if db != current {
+				db.close()
 			}
+			return cdl.Err(fmt.Errorf("dataset %s: %w", name, err), cdl.LayerErrorInternal)
 		}
 	}
+	if err := checkSchemaOnLoad(ctx, datasets); err != nil {
+		if db != current {
+			db.close()
+		}
+		return cdl.Err(err, cdl.LayerErrorBadParameter)
+	}
+
+	dl.mu.Lock()
+	oldDb := dl.db
+	dl.db = db
+	dl.datasets = datasets
+	dl.config = config
+	dl.mu.Unlock()
+
+	if oldDb != nil && oldDb != db {
+		oldDb.retire(dl.logger)
+	}
 
 	return nil
 }
+
+// sortedNames returns the names of the datasets in order, so they are processed predictably.
+func sortedNames(datasets map[string]*Dataset) []string {
+	names := make([]string, 0, len(datasets))
+	for name := range datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,144 @@
+package layer
+
+import (
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func testConfig(password string, tableName string) *common.Config {
+	return &common.Config{
+		NativeSystemConfig: common.NativeSystemConfig{
+			"host":     "localhost",
+			"port":     "1",
+			"database": "test",
+			"user":     "user",
+			"password": password,
+		},
+		DatasetDefinitions: []*common.DatasetDefinition{{
+			DatasetName:  "products",
+			SourceConfig: map[string]any{TableName: tableName},
+			OutgoingMappingConfig: &common.OutgoingMappingConfig{
+				PropertyMappings: []*common.ItemToEntityPropertyMapping{{Property: "id", IsIdentity: true}},
+			},
+		}},
+	}
+}
+
+func TestUpdateConfiguration(t *testing.T) {
+	logger := common.NewLogger("test", "text", "error")
+
+	t.Run("Should keep the connection pool when only dataset definitions change", func(t *testing.T) {
+		conf, _ := newMysqlConf(testConfig("pass", "product"))
+		pool := newTestPool(t)
+		pool.conf = conf
+		dl := &MysqlDatalayer{logger: logger, db: pool, datasets: map[string]*Dataset{}}
+
+		err := dl.UpdateConfiguration(testConfig("pass", "product_v2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dl.db != pool {
+			t.Fatalf("Expected connection pool to be reused")
+		}
+		if dl.datasets["products"].datasetDefinition.SourceConfig[TableName] != "product_v2" {
+			t.Fatalf("Expected dataset definition to be updated")
+		}
+	})
+
+	t.Run("Should keep the current state when the new connection fails", func(t *testing.T) {
+		conf, _ := newMysqlConf(testConfig("pass", "product"))
+		pool := newTestPool(t)
+		pool.conf = conf
+		dl := &MysqlDatalayer{logger: logger, db: pool, datasets: map[string]*Dataset{}}
+
+		err := dl.UpdateConfiguration(testConfig("other", "product_v2"))
+		if err == nil {
+			t.Fatalf("Expected reload with unreachable database to fail")
+		}
+		if dl.db != pool || len(dl.datasets) != 0 {
+			t.Fatalf("Expected previous state to be kept")
+		}
+	})
+
+	t.Run("Should only migrate tables of changed dataset definitions", func(t *testing.T) {
+		conf, _ := newMysqlConf(testConfig("pass", "product"))
+		pool := newTestPool(t)
+		pool.conf = conf
+		dl := &MysqlDatalayer{logger: logger, db: pool, datasets: map[string]*Dataset{}}
+		config := func(tableName string) *common.Config {
+			config := testConfig("pass", tableName)
+			config.DatasetDefinitions[0].SourceConfig[AutoCreateTable] = true
+			config.DatasetDefinitions[0].IncomingMappingConfig = &common.IncomingMappingConfig{
+				PropertyMappings: []*common.EntityToItemPropertyMapping{{Property: "id", IsIdentity: true}},
+			}
+			return config
+		}
+		dl.datasets["products"] = &Dataset{logger: logger, db: pool, datasetDefinition: config("product").DatasetDefinitions[0]}
+
+		// the pool cannot connect, so any DDL would fail the reload
+		if err := dl.UpdateConfiguration(config("product")); err != nil {
+			t.Fatalf("Expected an unchanged definition not to be migrated, got %v", err)
+		}
+		if err := dl.UpdateConfiguration(config("product_v2")); err == nil {
+			t.Fatalf("Expected a changed definition to be migrated")
+		}
+	})
+
+	t.Run("Should reject a changed health_port", func(t *testing.T) {
+		conf, _ := newMysqlConf(testConfig("pass", "product"))
+		pool := newTestPool(t)
+		pool.conf = conf
+		dl := &MysqlDatalayer{logger: logger, db: pool, datasets: map[string]*Dataset{}}
+
+		config := testConfig("pass", "product_v2")
+		config.NativeSystemConfig["health_port"] = "8091"
+		err := dl.UpdateConfiguration(config)
+		if err == nil {
+			t.Fatalf("Expected reload with a new health_port to fail")
+		}
+		if dl.db != pool || len(dl.datasets) != 0 {
+			t.Fatalf("Expected previous state to be kept")
+		}
+	})
+}
+
+func TestMysqlConfAddresses(t *testing.T) {
+	t.Run("Should prefer the socket over hosts", func(t *testing.T) {
+		config := testConfig("pass", "product")
+		config.NativeSystemConfig["socket"] = "/var/run/mysqld/mysqld.sock"
+		config.NativeSystemConfig["hosts"] = []any{"db1", "db2"}
+		conf, _ := newMysqlConf(config)
+		addresses := conf.addresses()
+		if len(addresses) != 1 || addresses[0] != "unix(/var/run/mysqld/mysqld.sock)" {
+			t.Fatalf("Unexpected addresses %v", addresses)
+		}
+	})
+
+	t.Run("Should list hosts in order with the default port", func(t *testing.T) {
+		config := testConfig("pass", "product")
+		config.NativeSystemConfig["hosts"] = "db1, db2:6446"
+		conf, err := newMysqlConf(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses := conf.addresses()
+		if len(addresses) != 2 || addresses[0] != "tcp(db1:1)" || addresses[1] != "tcp(db2:6446)" {
+			t.Fatalf("Unexpected addresses %v", addresses)
+		}
+	})
+}
+
+func TestColumnCase(t *testing.T) {
+	t.Run("Should preserve columns unless lower is configured", func(t *testing.T) {
+		for value, expected := range map[string]string{"": ColumnCasePreserve, ColumnCaseLower: ColumnCaseLower, ColumnCasePreserve: ColumnCasePreserve} {
+			sourceConfig := map[string]any{}
+			if value != "" {
+				sourceConfig[ColumnCase] = value
+			}
+			if mode := columnCase(&common.DatasetDefinition{SourceConfig: sourceConfig}); mode != expected {
+				t.Errorf("Expected %s for %q, got %s", expected, value, mode)
+			}
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package layer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// datatypes lists the property mapping datatypes the writer can convert values for.
+var datatypes = map[string]bool{
+	"": true, "string": true,
+	"int": true, "integer": true, "long": true, "float": true, "double": true, "decimal": true,
+	"bool": true, "boolean": true,
+	"date": true, "time": true, "datetime": true, "timestamp": true,
+	"json": true, "list": true, "uuid": true, "base64": true,
+}
+
+var decimalPattern = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+// listDelimiter returns the delimiter configured in the custom settings of a list mapping.
+// Lists without a delimiter are written as json arrays.
+func listDelimiter(pm *common.EntityToItemPropertyMapping) string {
+	if pm == nil {
+		return ""
+	}
+	delimiter, _ := pm.Custom["delimiter"].(string)
+	return delimiter
+}
+
+// convertRow replaces the values of a mapped row with statement arguments, converted by the
+// datatype of the column's property mapping. The original values stay in the row's map.
+func (o *MysqlWriter) convertRow(item *RowItem) error {
+	for i, val := range item.Values {
+		col := item.Columns[i]
+		converted, err := convertValue(val, o.mapping(col))
+		if err != nil {
+			return fmt.Errorf("property %s: %w", col, err)
+		}
+		item.Values[i] = converted
+	}
+	return nil
+}
+
+// convertValue converts a mapped value to a statement argument for a property mapping, which
+// may be nil for columns without one.
+func convertValue(v any, pm *common.EntityToItemPropertyMapping) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	datatype := ""
+	if pm != nil {
+		datatype = pm.Datatype
+	}
+	switch datatype {
+	case "bool", "boolean":
+		return toBool(v)
+	case "int", "integer", "long":
+		return toInt(v)
+	case "float", "double":
+		return toFloat(v)
+	case "decimal":
+		return toDecimal(v)
+	case "date":
+		return toTime(v, "2006-01-02", "2006-01-02")
+	case "time":
+		return toTime(v, "15:04:05", "15:04:05.999999")
+	case "datetime":
+		return toTime(v, "2006-01-02 15:04:05", "2006-01-02 15:04:05")
+	case "timestamp":
+		return toTime(v, "2006-01-02 15:04:05", "2006-01-02 15:04:05-0700")
+	case "json":
+		return toJSON(v)
+	case "list":
+		return toList(v, listDelimiter(pm))
+	case "uuid":
+		return toUUID(v)
+	case "base64":
+		return toBytes(v)
+	default:
+		return toDefault(v)
+	}
+}
+
+func toDefault(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return toBool(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v, nil
+	case []any, []string, map[string]any:
+		return toJSON(v)
+	default:
+		return fmt.Sprintf("%v", v), nil
+	}
+}
+
+func toBool(v any) (any, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case float64:
+		if v == 0 {
+			return 0, nil
+		}
+		return 1, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+		return toBool(b)
+	}
+	return nil, fmt.Errorf("%v is not a boolean", v)
+}
+
+func toInt(v any) (any, error) {
+	switch v := v.(type) {
+	case float64:
+		if v != math.Trunc(v) {
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+		return int64(v), nil
+	case int, int64, int32, uint64, uint32:
+		return v, nil
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", v)
+		}
+		return i, nil
+	}
+	return nil, fmt.Errorf("%v is not an integer", v)
+}
+
+func toFloat(v any) (any, error) {
+	switch v := v.(type) {
+	case float64, float32, int, int64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("%v is not a number", v)
+}
+
+// toDecimal passes decimals as strings, so MySQL converts them without floating point rounding.
+func toDecimal(v any) (any, error) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int, int64:
+		return fmt.Sprintf("%d", v), nil
+	case string:
+		s := strings.TrimSpace(v)
+		if !decimalPattern.MatchString(s) {
+			return nil, fmt.Errorf("%q is not a decimal", v)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("%v is not a decimal", v)
+}
+
+// toTime parses an RFC3339 string, or a string already in the MySQL layout, and formats it in
+// the given layout.
+func toTime(v any, mysqlLayout string, layout string) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a date or time string", v)
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		t, err = time.Parse(mysqlLayout, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an RFC3339 or %s value", s, mysqlLayout)
+	}
+	return t.Format(layout), nil
+}
+
+// toJSON stores strings that already hold json as they are, and encodes all other values.
+func toJSON(v any) (any, error) {
+	if s, ok := v.(string); ok && json.Valid([]byte(s)) {
+		return s, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%v cannot be encoded as json: %w", v, err)
+	}
+	return string(data), nil
+}
+
+func toList(v any, delimiter string) (any, error) {
+	var list []any
+	switch v := v.(type) {
+	case []any:
+		list = v
+	case []string:
+		for _, s := range v {
+			list = append(list, s)
+		}
+	default:
+		list = []any{v}
+	}
+	if delimiter == "" {
+		data, err := json.Marshal(list)
+		if err != nil {
+			return nil, fmt.Errorf("%v cannot be encoded as json: %w", v, err)
+		}
+		return string(data), nil
+	}
+	parts := make([]string, len(list))
+	for i, item := range list {
+		parts[i] = fmt.Sprintf("%v", item)
+		if strings.Contains(parts[i], delimiter) {
+			return nil, fmt.Errorf("list item %q contains the delimiter %q", parts[i], delimiter)
+		}
+	}
+	return strings.Join(parts, delimiter), nil
+}
+
+// toUUID converts a uuid string to its 16 bytes, for BINARY(16) columns.
+func toUUID(v any) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a uuid", v)
+	}
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a uuid", s)
+	}
+	return id[:], nil
+}
+
+// toBytes decodes standard or url-safe base64, with or without padding.
+func toBytes(v any) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a base64 string", v)
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := encoding.DecodeString(s); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not base64", s)
+}
@@ -0,0 +1,67 @@
+package layer
+
+import (
+	"reflect"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestConvertValue(t *testing.T) {
+	mapping := func(datatype string) *common.EntityToItemPropertyMapping {
+		return &common.EntityToItemPropertyMapping{Property: "p", Datatype: datatype}
+	}
+
+	t.Run("Should convert values by datatype", func(t *testing.T) {
+		list := mapping("list")
+		list.Custom = map[string]any{"delimiter": ","}
+		for _, tc := range []struct {
+			value    any
+			pm       *common.EntityToItemPropertyMapping
+			expected any
+		}{
+			{true, nil, 1},
+			{"false", mapping("bool"), 0},
+			{42.0, mapping("long"), int64(42)},
+			{"12.50", mapping("decimal"), "12.50"},
+			{0.1, mapping("decimal"), "0.1"},
+			{"2024-01-02T03:04:05Z", mapping("date"), "2024-01-02"},
+			{"2024-01-02T03:04:05.5Z", mapping("time"), "03:04:05.5"},
+			{"2024-01-02T03:04:05Z", mapping("datetime"), "2024-01-02 03:04:05"},
+			{map[string]any{"a": 1.0}, mapping("json"), `{"a":1}`},
+			{`{"a":1}`, mapping("json"), `{"a":1}`},
+			{[]any{"a", "b"}, nil, `["a","b"]`},
+			{[]any{"a", "b"}, mapping("list"), `["a","b"]`},
+			{[]any{"a", "b"}, list, "a,b"},
+			{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", mapping("uuid"), []byte{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}},
+			{"aGVsbG8=", mapping("base64"), []byte("hello")},
+			{nil, mapping("int"), nil},
+		} {
+			converted, err := convertValue(tc.value, tc.pm)
+			if err != nil {
+				t.Fatalf("Unexpected error for %v: %v", tc.value, err)
+			}
+			if !reflect.DeepEqual(converted, tc.expected) {
+				t.Errorf("Expected %v (%T) for %v, got %v (%T)", tc.expected, tc.expected, tc.value, converted, converted)
+			}
+		}
+	})
+
+	t.Run("Should report values that cannot be converted", func(t *testing.T) {
+		for _, tc := range []struct {
+			value any
+			pm    *common.EntityToItemPropertyMapping
+		}{
+			{"yes please", mapping("bool")},
+			{1.5, mapping("int")},
+			{"12,50", mapping("decimal")},
+			{"yesterday", mapping("datetime")},
+			{"not-a-uuid", mapping("uuid")},
+			{"%%%", mapping("base64")},
+		} {
+			if _, err := convertValue(tc.value, tc.pm); err == nil {
+				t.Errorf("Expected an error for %v as %s", tc.value, tc.pm.Datatype)
+			}
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+const (
+	// mysql error returned when the server rejects the user or password
+	errAccessDenied = 1045
+
+	defaultCredentialsRefreshInterval = 30 * time.Second
+)
+
+// loadCredentialFiles replaces user and password with the contents of user_file and
+// password_file, when configured. Surrounding whitespace, such as a trailing newline
+// in a mounted secret, is removed.
+func (c *MysqlConf) loadCredentialFiles() error {
+	if c.UserFile != "" {
+		user, err := readCredentialFile(c.UserFile)
+		if err != nil {
+			return err
+		}
+		c.User = user
+	}
+	if c.PasswordFile != "" {
+		password, err := readCredentialFile(c.PasswordFile)
+		if err != nil {
+			return err
+		}
+		c.Password = password
+	}
+	return nil
+}
+
+func readCredentialFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read credential file %s because %s", path, err.Error())
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// credentialsRefreshInterval returns how often credential files are checked for changes.
+func (c *MysqlConf) credentialsRefreshInterval() time.Duration {
+	if c.CredentialsRefreshInterval == "" {
+		return defaultCredentialsRefreshInterval
+	}
+	d, err := time.ParseDuration(c.CredentialsRefreshInterval)
+	if err != nil || d <= 0 {
+		return defaultCredentialsRefreshInterval
+	}
+	return d
+}
+
+// watchCredentials polls the configured credential files and rebuilds the connection
+// pool when their contents change. It runs until stop is closed.
+func (dl *MysqlDatalayer) watchCredentials(stop <-chan struct{}) {
+	for {
+		dl.mu.RLock()
+		interval := defaultCredentialsRefreshInterval
+		if dl.db != nil {
+			interval = dl.db.conf.credentialsRefreshInterval()
+		}
+		dl.mu.RUnlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		if dl.credentialsChanged() {
+			select {
+			case <-stop:
+				// stopped while polling, leave the closed layer alone
+				return
+			default:
+			}
+			dl.logger.Info("credential files changed, reconnecting")
+			if err := dl.refreshCredentials(); err != nil {
+				dl.logger.Error("failed to reconnect with new credentials", "error", err)
+			}
+		}
+	}
+}
+
+func (dl *MysqlDatalayer) credentialsChanged() bool {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	if dl.db == nil {
+		return false
+	}
+	current := dl.db.conf
+	if current.UserFile == "" && current.PasswordFile == "" {
+		return false
+	}
+	reloaded := *current
+	if err := reloaded.loadCredentialFiles(); err != nil {
+		dl.logger.Warn("failed to read credential files", "error", err)
+		return false
+	}
+	return reloaded.User != current.User || reloaded.Password != current.Password
+}
+
+// refreshCredentials re-applies the current configuration, which re-reads credential files
+// and replaces the connection pool if they changed.
+func (dl *MysqlDatalayer) refreshCredentials() cdl.LayerError {
+	dl.mu.RLock()
+	config := dl.config
+	dl.mu.RUnlock()
+	return dl.UpdateConfiguration(config)
+}
+
+// reconnectDataset is used by datasets after an access denied or connection error. It re-reads
+// credentials, or fails over to the next host, and returns the dataset from the refreshed state.
+// It returns nil if the pool of the dataset is still current and a retry would fail the same way.
+func (dl *MysqlDatalayer) reconnectDataset(d *Dataset, cause error) *Dataset {
+	dl.mu.RLock()
+	current := dl.db
+	ds := dl.datasets[d.Name()]
+	dl.mu.RUnlock()
+	if current != d.db {
+		// another request already replaced the pool the dataset failed on
+		return ds
+	}
+
+	var err cdl.LayerError
+	if isAccessDenied(cause) {
+		err = dl.refreshCredentials()
+	} else if isConnectionError(cause) && d.db != nil && len(d.db.conf.addresses()) > 1 {
+		dl.logger.Warn("connection to database failed, failing over", "address", d.db.address, "error", cause)
+		err = dl.failover()
+	} else {
+		return nil
+	}
+	if err != nil {
+		dl.logger.Error("failed to reconnect", "error", err)
+		return nil
+	}
+
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	if dl.db == d.db {
+		return nil
+	}
+	return dl.datasets[d.Name()]
+}
+
+// isAccessDenied reports whether err, possibly wrapped in a LayerError, is mysql error 1045.
+func isAccessDenied(err error) bool {
+	return mysqlErrorNumber(err) == errAccessDenied
+}
+
+func mysqlErrorNumber(err error) uint16 {
+	if lerr, ok := err.(cdl.LayerError); ok {
+		err = lerr.Underlying()
+	}
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) {
+		return merr.Number
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestCredentialFiles(t *testing.T) {
+	t.Run("Should read user and password from files", func(t *testing.T) {
+		dir := t.TempDir()
+		userFile := filepath.Join(dir, "user")
+		passwordFile := filepath.Join(dir, "password")
+		os.WriteFile(userFile, []byte("fileuser\n"), 0600)
+		os.WriteFile(passwordFile, []byte("filepassword\n"), 0600)
+
+		config := testConfig("pass", "product")
+		config.NativeSystemConfig["user_file"] = userFile
+		config.NativeSystemConfig["password_file"] = passwordFile
+		conf, err := newMysqlConf(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.User != "fileuser" || conf.Password != "filepassword" {
+			t.Fatalf("Expected credentials from files, got %s/%s", conf.User, conf.Password)
+		}
+	})
+
+	t.Run("Should fail when a credential file is missing", func(t *testing.T) {
+		config := testConfig("pass", "product")
+		config.NativeSystemConfig["password_file"] = filepath.Join(t.TempDir(), "missing")
+		if _, err := newMysqlConf(config); err == nil {
+			t.Fatalf("Expected error for missing credential file")
+		}
+	})
+
+	t.Run("Should detect access denied errors wrapped in layer errors", func(t *testing.T) {
+		merr := &mysql.MySQLError{Number: 1045, Message: "Access denied"}
+		if !isAccessDenied(ErrQuery(merr)) {
+			t.Fatalf("Expected wrapped 1045 to be access denied")
+		}
+		if !isAccessDenied(common.Err(merr, common.LayerErrorInternal)) {
+			t.Fatalf("Expected 1045 to be access denied")
+		}
+		if isAccessDenied(fmt.Errorf("other")) {
+			t.Fatalf("Expected other errors not to be access denied")
+		}
+	})
+	t.Run("Should stop the credential watcher once, even if stopped twice", func(t *testing.T) {
+		dl := &MysqlDatalayer{logger: common.NewLogger("test", "text", "error"), stop: make(chan struct{})}
+		done := make(chan struct{})
+		go func() {
+			dl.watchCredentials(dl.stop)
+			close(done)
+		}()
+		if err := dl.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := dl.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the watcher to stop")
+		}
+	})
+
+	t.Run("Should return the current dataset if its pool was already replaced", func(t *testing.T) {
+		definition := &common.DatasetDefinition{DatasetName: "products"}
+		current := &Dataset{db: newTestPool(t), datasetDefinition: definition}
+		dl := &MysqlDatalayer{logger: common.NewLogger("test", "text", "error"), db: current.db, datasets: map[string]*Dataset{"products": current}}
+		stale := &Dataset{db: newTestPool(t), datasetDefinition: definition, layer: dl}
+		if ds := dl.reconnectDataset(stale, fmt.Errorf("other")); ds != current {
+			t.Fatalf("Expected the current dataset, got %v", ds)
+		}
+		if ds := dl.reconnectDataset(current, fmt.Errorf("other")); ds != nil {
+			t.Fatalf("Expected no retry on the current pool, got %v", ds)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// mysql errors caused by the values of a row rather than by the batch as a whole
+var dataErrors = map[uint16]bool{
+	1048: true, // column cannot be null
+	1264: true, // out of range value
+	1265: true, // data truncated
+	1292: true, // incorrect datetime value
+	1366: true, // incorrect string or number value
+	1406: true, // data too long
+	1452: true, // foreign key constraint fails
+	3140: true, // invalid json text
+}
+
+// isDataError reports whether err is caused by the values of a row.
+func isDataError(err error) bool {
+	return dataErrors[mysqlErrorNumber(err)]
+}
+
+// execBatch runs the statements of a batch and returns the ones that ran. With a dead letter
+// table configured, an insert failing with a data error, in its own rows or in their child
+// rows, is split up until the offending rows are found, and those are written to the dead
+// letter table instead.
+func (o *MysqlWriter) execBatch(statements []statement) ([]statement, error) {
+	executed := make([]statement, 0, len(statements))
+	for _, st := range statements {
+		ran, err := o.execInsert(st)
+		executed = append(executed, ran...)
+		if err == nil {
+			continue
+		}
+		if o.deadLetterTable == "" || len(st.rows) == 0 || !isDataError(err) {
+			return executed, err
+		}
+		ran, err = o.bisect(st.rows, err)
+		executed = append(executed, ran...)
+		if err != nil {
+			return executed, err
+		}
+	}
+	return executed, nil
+}
+
+// execInsert runs a statement and then the inserts of its child rows. If a child insert fails,
+// the rows inserted by the statement are removed again, so no parent is left without its
+// children, and the error of the child insert is returned.
+func (o *MysqlWriter) execInsert(st statement) ([]statement, error) {
+	err := o.exec(st.stmt, st.args)
+	if err != nil {
+		return nil, err
+	}
+	executed := []statement{st}
+	for _, child := range st.children {
+		err = o.exec(child.stmt, child.args)
+		if err == nil {
+			executed = append(executed, child)
+			continue
+		}
+		keys := make([]rowKey, len(st.rows))
+		for i, row := range st.rows {
+			keys[i] = row.Key
+		}
+		undo := o.childDeleteStatements(keys)
+		for _, chunk := range o.chunkKeys(keys) {
+			stmt, args := o.deleteStatement(chunk)
+			undo = append(undo, statement{stmt: stmt, args: args})
+		}
+		if undoErr := o.execAll(undo); undoErr != nil {
+			return executed, fmt.Errorf("could not remove rows after their child rows failed: %w, underlying: %w", undoErr, err)
+		}
+		return append(executed, undo...), err
+	}
+	return executed, nil
+}
+
+// bisect inserts rows that failed together with cause by halves. A failed statement is rolled
+// back on its own by mysql, so the transaction can carry on with the other half.
+func (o *MysqlWriter) bisect(rows []EntityInsert, cause error) ([]statement, error) {
+	if len(rows) == 1 {
+		st := o.deadLetterStatement(rows[0], cause)
+		err := o.exec(st.stmt, st.args)
+		if err != nil {
+			return nil, fmt.Errorf("could not write entity %s to dead letter table: %w, underlying: %w", rows[0].Id, err, cause)
+		}
+		o.logger.Warn("entity written to dead letter table", "dataset", o.dataset, "id", rows[0].Id, "error", cause)
+		o.failed++
+		return []statement{st}, nil
+	}
+
+	var executed []statement
+	half := len(rows) / 2
+	for _, part := range [][]EntityInsert{rows[:half], rows[half:]} {
+		ran, err := o.execInsert(o.insertStatement(part))
+		executed = append(executed, ran...)
+		if err == nil {
+			continue
+		}
+		if !isDataError(err) {
+			return executed, err
+		}
+		ran, err = o.bisect(part, err)
+		executed = append(executed, ran...)
+		if err != nil {
+			return executed, err
+		}
+	}
+	return executed, nil
+}
+
+func (o *MysqlWriter) deadLetterStatement(row EntityInsert, cause error) statement {
+	var entity any
+	if row.Entity != nil {
+		data, err := json.Marshal(row.Entity)
+		if err == nil {
+			entity = string(data)
+		}
+	}
+	return statement{
+		stmt: "INSERT INTO " + o.deadLetterTable + " (`dataset`, `entity_id`, `error`, `entity`, `failed_at`) VALUES (?, ?, ?, ?, NOW(6))",
+		args: []any{o.dataset, row.Id, cause.Error(), entity},
+	}
+}
@@ -0,0 +1,71 @@
+package layer
+
+import (
+	"context"
+	"time"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+const describeTimeout = 10 * time.Second
+
+// describe builds the dataset description from the dataset definition, and the table columns
+// from information_schema. Schema lookup failures are reported in the metadata instead of
+// failing the whole listing.
+func (d *Dataset) describe(ctx context.Context) *cdl.DatasetDescription {
+	sourceConfig := d.datasetDefinition.SourceConfig
+	tableName := getConfigProperty(sourceConfig, TableName)
+	sinceColumn := getConfigProperty(sourceConfig, SinceColumn)
+	sinceTable := getConfigProperty(sourceConfig, SinceTable)
+	if sinceColumn != "" && sinceTable == "" {
+		sinceTable = tableName
+	}
+
+	readable := d.datasetDefinition.OutgoingMappingConfig != nil || getConfigProperty(sourceConfig, EntityColumn) != ""
+	writable := d.datasetDefinition.IncomingMappingConfig != nil && tableName != ""
+	var routeTables []string
+	if routes, err := routeDefinitions(d.datasetDefinition); err == nil {
+		for _, route := range routes {
+			routeTables = append(routeTables, getConfigProperty(route.definition.SourceConfig, TableName))
+		}
+	}
+	writable = writable || len(routeTables) > 0
+
+	metadata := map[string]any{
+		"operations": map[string]bool{
+			"changes":     readable,
+			"entities":    readable,
+			"since_token": readable && sinceColumn != "",
+			"latest_only": false,
+			"incremental": writable,
+			"full_sync":   false,
+		},
+		"table_name":        tableName,
+		"since_table":       sinceTable,
+		"since_column":      sinceColumn,
+		"write_mode":        "upsert", // append_mode is not implemented by the writer
+		"transaction_scope": transactionScope(d.datasetDefinition),
+	}
+	if len(routeTables) > 0 {
+		metadata["route_tables"] = routeTables
+	}
+
+	if tableName != "" {
+		if err := d.db.acquire(); err != nil {
+			metadata["schema_error"] = err.Error()
+		} else {
+			columns, err := d.tableColumns(ctx, tableName)
+			d.db.release()
+			if err != nil {
+				metadata["schema_error"] = err.Error()
+			} else {
+				metadata["columns"] = columns
+			}
+		}
+	}
+
+	return &cdl.DatasetDescription{
+		Name:     d.Name(),
+		Metadata: metadata,
+	}
+}
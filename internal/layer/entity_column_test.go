@@ -0,0 +1,76 @@
+package layer
+
+import (
+	"reflect"
+	"testing"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestEntityColumnWrite(t *testing.T) {
+	t.Run("Should store the entity json so it reads back unchanged", func(t *testing.T) {
+		w := newKeyTestWriter(t, map[string]any{EntityColumn: "entity"})
+		w.entityColumn = "entity"
+		entity := egdm.NewEntity().SetID("http://data.test/1")
+		entity.SetProperty("http://data.test/name", "widget")
+		entity.SetProperty("http://data.test/tags", []any{"a", "b"})
+		entity.SetReference("http://data.test/owner", "http://data.test/people/2")
+		entity.Recorded = 7
+		if err := w.Write(entity); err != nil {
+			t.Fatal(err)
+		}
+
+		row := w.batchInserts["1"].RowItem
+		if !reflect.DeepEqual(row.Columns, []string{"id", "name", "entity"}) {
+			t.Fatalf("Unexpected columns %v", row.Columns)
+		}
+		parsed, err := parseEntityColumn(row.Values[2].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.ID != entity.ID || parsed.Recorded != 7 || !reflect.DeepEqual(parsed.Properties, entity.Properties) || !reflect.DeepEqual(parsed.References, entity.References) {
+			t.Fatalf("Expected %+v, got %+v", entity, parsed)
+		}
+	})
+
+	t.Run("Should delete the rows of deleted entities", func(t *testing.T) {
+		w := newKeyTestWriter(t, map[string]any{EntityColumn: "entity"})
+		w.entityColumn = "entity"
+		if err := w.Write(egdm.NewEntity().SetID("http://data.test/1")); err != nil {
+			t.Fatal(err)
+		}
+		deleted := egdm.NewEntity().SetID("http://data.test/1")
+		deleted.IsDeleted = true
+		if err := w.Write(deleted); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := w.batchInserts["1"]; found {
+			t.Fatalf("Expected the deleted entity not to be written as a row")
+		}
+		if len(w.deleteKeys) != 1 || w.deleteKeys[0].id != "1" {
+			t.Fatalf("Expected the row to be deleted, got %v", w.deleteKeys)
+		}
+	})
+
+	t.Run("Should keep deleted entities with the serialized entity when a recorded column needs them", func(t *testing.T) {
+		w := newKeyTestWriter(t, map[string]any{EntityColumn: "entity", RecordedColumn: "recorded"})
+		w.entityColumn = "entity"
+		w.recordedColumn = "recorded"
+		deleted := egdm.NewEntity().SetID("http://data.test/1")
+		deleted.IsDeleted = true
+		if err := w.Write(deleted); err != nil {
+			t.Fatal(err)
+		}
+		row, found := w.batchInserts["1"]
+		if !found {
+			t.Fatalf("Expected the deleted entity to be kept as a row")
+		}
+		parsed, err := parseEntityColumn(row.RowItem.Values[len(row.RowItem.Values)-1].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.ID != deleted.ID || !parsed.IsDeleted {
+			t.Fatalf("Expected a deleted entity, got %+v", parsed)
+		}
+	})
+}
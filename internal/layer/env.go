@@ -0,0 +1,172 @@
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+const (
+	systemEnvPrefix  = "MYSQL_SYSTEM_"
+	datasetEnvPrefix = "MYSQL_DATASET_"
+)
+
+// legacyEnvOverrides maps the fixed MYSQL_* variables to system_config keys, in the order they
+// are applied. MYSQL_HOST wins over MYSQL_HOSTNAME.
+var legacyEnvOverrides = []struct {
+	name string
+	key  string
+}{
+	{"MYSQL_USER", "user"},
+	{"MYSQL_PASSWORD", "password"},
+	{"MYSQL_USER_FILE", "user_file"},
+	{"MYSQL_PASSWORD_FILE", "password_file"},
+	{"MYSQL_DATABASE", "database"},
+	{"MYSQL_HOSTNAME", "host"},
+	{"MYSQL_HOST", "host"},
+	{"MYSQL_PORT", "port"},
+}
+
+// applyLegacyEnvOverrides sets system_config keys from the fixed MYSQL_* variables. Variables
+// that are unset or empty are ignored.
+func applyLegacyEnvOverrides(config *cdl.Config, getenv func(string) string) {
+	for _, env := range legacyEnvOverrides {
+		if value := getenv(env.name); value != "" {
+			config.NativeSystemConfig[env.key] = value
+		}
+	}
+}
+
+// systemConfigKinds declares the value type of the system_config keys read by MysqlConf, used
+// to coerce environment overrides. The port settings are strings in MysqlConf, so
+// MYSQL_SYSTEM_PORT=3307 must not become a number. Keys that are not listed here take the type
+// of their configured value.
+var systemConfigKinds = map[string]configKind{
+	"host":                         kindString,
+	"port":                         kindString,
+	"hosts":                        kindString,
+	"socket":                       kindString,
+	"database":                     kindString,
+	"user":                         kindString,
+	"password":                     kindString,
+	"user_file":                    kindString,
+	"password_file":                kindString,
+	"schema":                       kindString,
+	"health_port":                  kindString,
+	"credentials_refresh_interval": kindString,
+}
+
+// applyEnvOverrides sets system_config keys from MYSQL_SYSTEM_<KEY> and dataset source_config
+// keys from MYSQL_DATASET_<NAME>_<KEY> environment variables. KEY is matched case-insensitively
+// against the config key, NAME is the dataset name in upper case with every character that is
+// not a letter or digit replaced by an underscore. Variables with an empty value are ignored,
+// like the fixed MYSQL_* variables.
+func applyEnvOverrides(config *cdl.Config, environ []string) error {
+	// sort dataset prefixes longest first, so that a dataset named "products_v2" wins over "products"
+	type datasetPrefix struct {
+		prefix     string
+		definition *cdl.DatasetDefinition
+	}
+	var datasetPrefixes []datasetPrefix
+	for _, dsd := range config.DatasetDefinitions {
+		datasetPrefixes = append(datasetPrefixes, datasetPrefix{datasetEnvPrefix + envName(dsd.DatasetName) + "_", dsd})
+	}
+	sort.Slice(datasetPrefixes, func(i, j int) bool {
+		return len(datasetPrefixes[i].prefix) > len(datasetPrefixes[j].prefix)
+	})
+
+	for _, kv := range environ {
+		name, value, found := strings.Cut(kv, "=")
+		if !found || value == "" {
+			continue
+		}
+		if key, ok := strings.CutPrefix(name, systemEnvPrefix); ok && key != "" {
+			if config.NativeSystemConfig == nil {
+				config.NativeSystemConfig = make(cdl.NativeSystemConfig)
+			}
+			key = strings.ToLower(key)
+			kind, known := systemConfigKinds[key]
+			v, err := coerceEnvValue(value, key, kind, known, config.NativeSystemConfig[key])
+			if err != nil {
+				return fmt.Errorf("invalid value in %s: %w", name, err)
+			}
+			config.NativeSystemConfig[key] = v
+			continue
+		}
+		if !strings.HasPrefix(name, datasetEnvPrefix) {
+			continue
+		}
+		for _, dp := range datasetPrefixes {
+			key, ok := strings.CutPrefix(name, dp.prefix)
+			if !ok || key == "" {
+				continue
+			}
+			if dp.definition.SourceConfig == nil {
+				dp.definition.SourceConfig = make(map[string]any)
+			}
+			key = strings.ToLower(key)
+			option, known := sourceConfigOptions[key]
+			v, err := coerceEnvValue(value, key, option.kind, known, dp.definition.SourceConfig[key])
+			if err != nil {
+				return fmt.Errorf("invalid value in %s: %w", name, err)
+			}
+			dp.definition.SourceConfig[key] = v
+			break
+		}
+	}
+	return nil
+}
+
+func envName(datasetName string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(datasetName))
+}
+
+// coerceEnvValue converts value to the declared kind of key, or to the type of the currently
+// configured value if the key is not known. Numbers become float64 like they would when read
+// from json.
+func coerceEnvValue(value string, key string, kind configKind, known bool, current any) (any, error) {
+	if !known {
+		switch current.(type) {
+		case float64:
+			kind = kindNumber
+		case bool:
+			kind = kindBool
+		case []any, map[string]any:
+			kind = kindJSON
+		default:
+			kind = kindString
+		}
+	}
+
+	switch kind {
+	case kindNumber:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", key)
+		}
+		return f, nil
+	case kindBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", key)
+		}
+		return b, nil
+	case kindJSON:
+		var v any
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return nil, fmt.Errorf("%s must be valid json", key)
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
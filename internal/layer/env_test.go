@@ -0,0 +1,100 @@
+package layer
+
+import (
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	newConfig := func() *common.Config {
+		return &common.Config{
+			NativeSystemConfig: common.NativeSystemConfig{"host": "localhost"},
+			DatasetDefinitions: []*common.DatasetDefinition{
+				{DatasetName: "products", SourceConfig: map[string]any{TableName: "product", FlushThreshold: 1000.0}},
+				{DatasetName: "products-v2", SourceConfig: map[string]any{TableName: "product2"}},
+			},
+		}
+	}
+
+	t.Run("Should override system config keys", func(t *testing.T) {
+		config := newConfig()
+		err := applyEnvOverrides(config, []string{"MYSQL_SYSTEM_HOST=db.example.io", "MYSQL_SYSTEM_SCHEMA=sales"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.NativeSystemConfig["host"] != "db.example.io" || config.NativeSystemConfig["schema"] != "sales" {
+			t.Fatalf("Unexpected system config %+v", config.NativeSystemConfig)
+		}
+	})
+
+	t.Run("Should keep numeric system overrides in the type MysqlConf reads", func(t *testing.T) {
+		config := newConfig()
+		config.NativeSystemConfig["port"] = 3306.0
+		config.NativeSystemConfig["pool_size"] = 10.0
+		err := applyEnvOverrides(config, []string{
+			"MYSQL_SYSTEM_PORT=3307",
+			"MYSQL_SYSTEM_HEALTH_PORT=8091",
+			"MYSQL_SYSTEM_POOL_SIZE=20",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.NativeSystemConfig["pool_size"] != 20.0 {
+			t.Fatalf("Expected unknown numeric key to stay a number, got %#v", config.NativeSystemConfig["pool_size"])
+		}
+		conf, lerr := newMysqlConf(config)
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		if conf.Port != "3307" || conf.HealthPort != "8091" {
+			t.Fatalf("Unexpected ports %q and %q", conf.Port, conf.HealthPort)
+		}
+	})
+
+	t.Run("Should override dataset source config keys with type coercion", func(t *testing.T) {
+		config := newConfig()
+		err := applyEnvOverrides(config, []string{
+			"MYSQL_DATASET_PRODUCTS_FLUSH_THRESHOLD=50",
+			"MYSQL_DATASET_PRODUCTS_APPEND_MODE=true",
+			"MYSQL_DATASET_PRODUCTS_V2_TABLE_NAME=product3",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		products := config.DatasetDefinitions[0].SourceConfig
+		if products[FlushThreshold] != 50.0 || products[AppendMode] != true {
+			t.Fatalf("Unexpected source config %+v", products)
+		}
+		if config.DatasetDefinitions[1].SourceConfig[TableName] != "product3" {
+			t.Fatalf("Expected override to match the longest dataset name, got %+v", config.DatasetDefinitions[1].SourceConfig)
+		}
+		if _, found := products["v2_table_name"]; found {
+			t.Fatalf("Expected override not to be applied to the shorter dataset name")
+		}
+	})
+
+	t.Run("Should reject values of the wrong type", func(t *testing.T) {
+		err := applyEnvOverrides(newConfig(), []string{"MYSQL_DATASET_PRODUCTS_FLUSH_THRESHOLD=many"})
+		if err == nil {
+			t.Fatalf("Expected error for non numeric flush threshold")
+		}
+	})
+
+	t.Run("Should ignore empty values", func(t *testing.T) {
+		config := newConfig()
+		config.NativeSystemConfig["port"] = "3306"
+		env := map[string]string{"MYSQL_PORT": "", "MYSQL_HOSTNAME": "db.example.io", "MYSQL_HOST": ""}
+		applyLegacyEnvOverrides(config, func(name string) string { return env[name] })
+		err := applyEnvOverrides(config, []string{"MYSQL_SYSTEM_PORT=", "MYSQL_DATASET_PRODUCTS_TABLE_NAME="})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.NativeSystemConfig["port"] != "3306" || config.NativeSystemConfig["host"] != "db.example.io" {
+			t.Fatalf("Unexpected system config %+v", config.NativeSystemConfig)
+		}
+		if config.DatasetDefinitions[0].SourceConfig[TableName] != "product" {
+			t.Fatalf("Unexpected source config %+v", config.DatasetDefinitions[0].SourceConfig)
+		}
+	})
+}
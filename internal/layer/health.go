@@ -0,0 +1,359 @@
+package layer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+const healthCheckTimeout = 10 * time.Second
+
+// HealthReport is the result of a deep health check of the database and all datasets.
+type HealthReport struct {
+	Healthy   bool             `json:"healthy"`
+	CheckedAt time.Time        `json:"checked_at"`
+	Database  DatabaseStatus   `json:"database"`
+	Datasets  []*DatasetStatus `json:"datasets"`
+}
+
+type DatabaseStatus struct {
+	Reachable bool   `json:"reachable"`
+	Address   string `json:"address,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type DatasetStatus struct {
+	Name    string   `json:"name"`
+	Healthy bool     `json:"healthy"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Health pings the connection pool and checks that every dataset's tables and mapped columns
+// still exist.
+func (dl *MysqlDatalayer) Health(ctx context.Context) *HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	dl.mu.RLock()
+	db := dl.db
+	var datasets []*Dataset
+	for _, ds := range dl.datasets {
+		datasets = append(datasets, ds)
+	}
+	dl.mu.RUnlock()
+	sort.Slice(datasets, func(i, j int) bool {
+		return datasets[i].Name() < datasets[j].Name()
+	})
+
+	report := &HealthReport{CheckedAt: time.Now(), Datasets: []*DatasetStatus{}}
+	if db == nil {
+		report.Database.Error = "not connected"
+		return report
+	}
+	report.Database.Address = db.address
+	if err := db.acquire(); err != nil {
+		report.Database.Error = err.Error()
+		return report
+	}
+	defer db.release()
+
+	if err := db.db.PingContext(ctx); err != nil {
+		report.Database.Error = err.Error()
+		return report
+	}
+	report.Database.Reachable = true
+
+	report.Healthy = true
+	for _, ds := range datasets {
+		status := &DatasetStatus{Name: ds.Name()}
+		for _, err := range ds.checkSchema(ctx) {
+			status.Errors = append(status.Errors, err.Error())
+		}
+		status.Healthy = len(status.Errors) == 0
+		report.Healthy = report.Healthy && status.Healthy
+		report.Datasets = append(report.Datasets, status)
+	}
+	return report
+}
+
+// checkSchema verifies the dataset's table and the tables of its routes.
+func (d *Dataset) checkSchema(ctx context.Context) []error {
+	var errs []error
+	sourceConfig := d.datasetDefinition.SourceConfig
+	_, hasRoutes := sourceConfig[Routes]
+	// datasets that only route entities, or only read with a data_query, need no table
+	if getConfigProperty(sourceConfig, TableName) != "" || (!hasRoutes && getConfigProperty(sourceConfig, DataQuery) == "") {
+		errs = d.checkTable(ctx)
+	}
+	datasets, _, err := d.routeDatasets()
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, ds := range datasets {
+		for _, err := range ds.checkTable(ctx) {
+			errs = append(errs, fmt.Errorf("route to %s: %w", getConfigProperty(ds.datasetDefinition.SourceConfig, TableName), err))
+		}
+	}
+	return errs
+}
+
+// checkTable verifies that the dataset's table, since table and all columns referenced in its
+// mappings exist.
+func (d *Dataset) checkTable(ctx context.Context) []error {
+	var errs []error
+	sourceConfig := d.datasetDefinition.SourceConfig
+	tableName := getConfigProperty(sourceConfig, TableName)
+	if tableName == "" {
+		return []error{fmt.Errorf("%s is not configured", TableName)}
+	}
+
+	columns, err := d.tableColumns(ctx, tableName)
+	if err != nil {
+		return []error{fmt.Errorf("could not read columns of table %s: %w", tableName, err)}
+	}
+	if len(columns) == 0 {
+		return []error{fmt.Errorf("table %s does not exist", tableName)}
+	}
+
+	checkColumn := func(table string, columns []columnInfo, column string) {
+		if _, found := findColumn(columns, column); !found {
+			errs = append(errs, fmt.Errorf("column %s does not exist in table %s", column, table))
+		}
+	}
+	checkType := func(column string, datatype string) {
+		if c, found := findColumn(columns, column); found && !columnFits(datatype, c.DataType) {
+			errs = append(errs, fmt.Errorf("column %s in table %s has type %s, which does not fit datatype %s", column, tableName, c.ColumnType, datatype))
+		}
+	}
+
+	if entityColumn := getConfigProperty(sourceConfig, EntityColumn); entityColumn != "" {
+		checkColumn(tableName, columns, entityColumn)
+	}
+
+	if d.datasetDefinition.IncomingMappingConfig != nil {
+		idColumn, pattern, keys, err := keyConfig(d.datasetDefinition)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		mapped := map[string]bool{}
+		for _, pm := range d.datasetDefinition.IncomingMappingConfig.PropertyMappings {
+			// the identity is written to the columns of the identity pattern instead
+			if pattern != nil && pm.Property == idColumn {
+				continue
+			}
+			mapped[pm.Property] = true
+			if childTableName(pm.Custom) != "" {
+				continue
+			}
+			checkColumn(tableName, columns, pm.Property)
+			checkType(pm.Property, pm.Datatype)
+		}
+		for _, key := range keys {
+			if !mapped[key] {
+				checkColumn(tableName, columns, key)
+			}
+		}
+		if recordedColumn := getConfigProperty(sourceConfig, RecordedColumn); recordedColumn != "" {
+			checkColumn(tableName, columns, recordedColumn)
+		}
+		if !hasPrimaryKey(columns) {
+			errs = append(errs, fmt.Errorf("table %s has no primary key", tableName))
+		}
+	}
+
+	// columns of a custom data query do not have to come from table_name
+	if d.datasetDefinition.OutgoingMappingConfig != nil && getConfigProperty(sourceConfig, DataQuery) == "" {
+		joined := map[string]bool{}
+		if joins, err := joinDefinitions(d.datasetDefinition, ""); err == nil {
+			for _, join := range joins {
+				joined[join.property] = true
+			}
+		}
+		for _, pm := range d.datasetDefinition.OutgoingMappingConfig.PropertyMappings {
+			if childTableName(pm.Custom) == "" && !joined[pm.Property] {
+				checkColumn(tableName, columns, pm.Property)
+				checkType(pm.Property, pm.Datatype)
+			}
+		}
+	}
+
+	checkedChildren := map[string]bool{}
+	children := append(incomingChildTables(d.datasetDefinition, d.db.conf.Schema), outgoingChildTables(d.datasetDefinition, d.db.conf.Schema)...)
+	for _, child := range children {
+		name := child.name
+		if checkedChildren[name] {
+			continue
+		}
+		checkedChildren[name] = true
+		childColumns, err := d.tableColumns(ctx, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not read columns of child table %s: %w", name, err))
+			continue
+		}
+		if len(childColumns) == 0 {
+			errs = append(errs, fmt.Errorf("child table %s does not exist", name))
+			continue
+		}
+		for _, column := range []string{"parent_id", "value", "ordinal"} {
+			checkColumn(name, childColumns, column)
+		}
+	}
+
+	joins, err := joinDefinitions(d.datasetDefinition, d.db.conf.Schema)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, join := range joins {
+		checkColumn(tableName, columns, join.parentColumn)
+		joinColumns, err := d.tableColumns(ctx, join.name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not read columns of joined table %s: %w", join.name, err))
+			continue
+		}
+		if len(joinColumns) == 0 {
+			errs = append(errs, fmt.Errorf("joined table %s does not exist", join.name))
+			continue
+		}
+		checkColumn(join.name, joinColumns, join.joinColumn)
+		if join.orderBy != "" {
+			checkColumn(join.name, joinColumns, join.orderBy)
+		}
+		for _, column := range join.columns() {
+			checkColumn(join.name, joinColumns, column)
+		}
+	}
+
+	if sinceColumn := getConfigProperty(sourceConfig, SinceColumn); sinceColumn != "" {
+		sinceTable := getConfigProperty(sourceConfig, SinceTable)
+		sinceColumns := columns
+		if sinceTable != "" && sinceTable != tableName {
+			sinceColumns, err = d.tableColumns(ctx, sinceTable)
+			if err != nil {
+				return append(errs, fmt.Errorf("could not read columns of table %s: %w", sinceTable, err))
+			}
+			if len(sinceColumns) == 0 {
+				return append(errs, fmt.Errorf("since table %s does not exist", sinceTable))
+			}
+		} else {
+			sinceTable = tableName
+		}
+		if c, found := findColumn(sinceColumns, sinceColumn); !found {
+			errs = append(errs, fmt.Errorf("column %s does not exist in table %s", sinceColumn, sinceTable))
+		} else if !temporalTypes[c.DataType] && !numericTypes[c.DataType] {
+			errs = append(errs, fmt.Errorf("since column %s in table %s must be temporal or numeric, got %s", sinceColumn, sinceTable, c.ColumnType))
+		}
+	}
+
+	return errs
+}
+
+var temporalTypes = map[string]bool{"date": true, "datetime": true, "timestamp": true, "time": true, "year": true}
+
+var numericTypes = map[string]bool{
+	"tinyint": true, "smallint": true, "mediumint": true, "int": true, "bigint": true,
+	"decimal": true, "float": true, "double": true,
+}
+
+var integerTypes = map[string]bool{"tinyint": true, "smallint": true, "mediumint": true, "int": true, "bigint": true}
+
+var textTypes = map[string]bool{
+	"char": true, "varchar": true, "tinytext": true, "text": true, "mediumtext": true, "longtext": true,
+	"enum": true, "set": true,
+}
+
+var binaryTypes = map[string]bool{
+	"binary": true, "varbinary": true, "tinyblob": true, "blob": true, "mediumblob": true, "longblob": true,
+}
+
+// columnFits reports whether a column of an information_schema data type can hold the values of
+// a mapping datatype. Strings fit any column.
+func columnFits(datatype string, dataType string) bool {
+	switch datatype {
+	case "int", "integer", "long":
+		return integerTypes[dataType] || dataType == "decimal"
+	case "float", "double", "decimal":
+		return numericTypes[dataType]
+	case "bool", "boolean":
+		return integerTypes[dataType] || dataType == "bit"
+	case "date":
+		return dataType == "date" || dataType == "datetime" || dataType == "timestamp"
+	case "time":
+		return dataType == "time"
+	case "datetime", "timestamp":
+		return dataType == "datetime" || dataType == "timestamp"
+	case "json", "list":
+		return dataType == "json" || textTypes[dataType]
+	case "uuid", "base64":
+		return binaryTypes[dataType]
+	default:
+		return true
+	}
+}
+
+func hasPrimaryKey(columns []columnInfo) bool {
+	for _, c := range columns {
+		if c.PrimaryKey {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSchemaOnLoad runs checkSchema for every dataset with a table when a configuration is
+// loaded. Problems are logged, and returned for datasets with schema_check fail.
+func checkSchemaOnLoad(ctx context.Context, datasets map[string]*Dataset) error {
+	var errs []error
+	for _, name := range sortedNames(datasets) {
+		ds := datasets[name]
+		mode := schemaCheck(ds.datasetDefinition)
+		_, hasRoutes := ds.datasetDefinition.SourceConfig[Routes]
+		if mode == SchemaCheckOff || (getConfigProperty(ds.datasetDefinition.SourceConfig, TableName) == "" && !hasRoutes) {
+			continue
+		}
+		for _, err := range ds.checkSchema(ctx) {
+			ds.logger.Warn("schema check failed", "dataset", name, "error", err)
+			if mode == SchemaCheckFail {
+				errs = append(errs, fmt.Errorf("dataset %s: %w", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serveHealth exposes the health report on its own port, since the common web service only
+// offers a static /health endpoint. GET /health returns 200 when everything is healthy and 503
+// otherwise.
+func (dl *MysqlDatalayer) serveHealth(port string) cdl.LayerError {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		report := dl.Health(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			dl.logger.Warn("failed to write health report", "error", err)
+		}
+	})
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return cdl.Err(fmt.Errorf("could not listen on health port %s because %s", port, err.Error()), cdl.LayerErrorInternal)
+	}
+	dl.healthServer = &http.Server{Handler: mux, ReadHeaderTimeout: healthCheckTimeout}
+	go func() {
+		err := dl.healthServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			dl.logger.Error("health server stopped", "error", err)
+		}
+	}()
+	dl.logger.Info("serving health report", "port", port)
+	return nil
+}
@@ -0,0 +1,96 @@
+package layer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestHealth(t *testing.T) {
+	t.Run("Should report an unreachable database as unhealthy", func(t *testing.T) {
+		conf, _ := newMysqlConf(testConfig("pass", "product"))
+		pool := newTestPool(t)
+		pool.conf = conf
+		pool.address = "tcp(localhost:1)"
+		dl := &MysqlDatalayer{logger: common.NewLogger("test", "text", "error"), db: pool, datasets: map[string]*Dataset{}}
+
+		report := dl.Health(context.Background())
+		if report.Healthy || report.Database.Reachable {
+			t.Fatalf("Expected unhealthy report, got %+v", report)
+		}
+		if report.Database.Error == "" || report.Database.Address != "tcp(localhost:1)" {
+			t.Fatalf("Expected error and address in report, got %+v", report.Database)
+		}
+		if pool.usage() != 0 {
+			t.Fatalf("Expected health check to release the pool")
+		}
+	})
+
+	t.Run("Should not check a table for datasets read with a data_query", func(t *testing.T) {
+		pool := newTestPool(t)
+		ds := &Dataset{logger: common.NewLogger("test", "text", "error"), db: pool, datasetDefinition: &common.DatasetDefinition{
+			DatasetName:  "products",
+			SourceConfig: map[string]any{DataQuery: "SELECT * FROM product"},
+		}}
+		if errs := ds.checkSchema(context.Background()); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+	})
+}
+
+func TestColumnFits(t *testing.T) {
+	t.Run("Should match mapping datatypes to column types", func(t *testing.T) {
+		for _, c := range []struct {
+			datatype string
+			dataType string
+			fits     bool
+		}{
+			{"long", "bigint", true},
+			{"long", "varchar", false},
+			{"decimal", "decimal", true},
+			{"datetime", "date", false},
+			{"date", "datetime", true},
+			{"uuid", "binary", true},
+			{"uuid", "char", false},
+			{"json", "json", true},
+			{"bool", "tinyint", true},
+			{"string", "int", true},
+		} {
+			if columnFits(c.datatype, c.dataType) != c.fits {
+				t.Errorf("Expected %s in a %s column to fit: %v", c.datatype, c.dataType, c.fits)
+			}
+		}
+	})
+}
+
+func TestSchemaCheckOnLoad(t *testing.T) {
+	t.Run("Should only fail for datasets with schema_check fail", func(t *testing.T) {
+		conf, _ := newMysqlConf(testConfig("pass", "product"))
+		pool := newTestPool(t)
+		pool.conf = conf
+		logger := common.NewLogger("test", "text", "error")
+		dataset := func(mode string) map[string]*Dataset {
+			sourceConfig := map[string]any{TableName: "product"}
+			if mode != "" {
+				sourceConfig[SchemaCheck] = mode
+			}
+			return map[string]*Dataset{"products": {logger: logger, db: pool, datasetDefinition: &common.DatasetDefinition{DatasetName: "products", SourceConfig: sourceConfig}}}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := checkSchemaOnLoad(ctx, dataset("")); err != nil {
+			t.Fatalf("Expected warnings only by default, got %v", err)
+		}
+		if err := checkSchemaOnLoad(ctx, dataset(SchemaCheckOff)); err != nil {
+			t.Fatalf("Expected no check, got %v", err)
+		}
+		err := checkSchemaOnLoad(ctx, dataset(SchemaCheckFail))
+		if err == nil || !strings.Contains(err.Error(), "dataset products: could not read columns of table product") {
+			t.Fatalf("Expected schema check to fail, got %v", err)
+		}
+	})
+}
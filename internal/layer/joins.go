@@ -0,0 +1,217 @@
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// joinTable is a table joined to the rows of a dataset's table, one-to-many. The joined rows
+// of each root row are read into one property, as sub-entities mapped with the join's own
+// outgoing mapping, or as a list of the values of one column.
+type joinTable struct {
+	property     string
+	name         string
+	table        string
+	joinColumn   string
+	parentColumn string
+	orderBy      string
+	valueColumn  string
+	mapping      *cdl.OutgoingMappingConfig
+}
+
+// joinDefinitions parses the joins in the source_config of a dataset.
+func joinDefinitions(dsd *cdl.DatasetDefinition, schema string) ([]joinTable, error) {
+	value, found := dsd.SourceConfig[Joins]
+	if !found {
+		return nil, nil
+	}
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of joined tables", Joins)
+	}
+	joins := make([]joinTable, 0, len(list))
+	for i, v := range list {
+		config, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("join %d must be an object", i)
+		}
+		join := joinTable{
+			property:     getConfigProperty(config, "property"),
+			name:         getConfigProperty(config, TableName),
+			joinColumn:   getConfigProperty(config, "join_column"),
+			parentColumn: getConfigProperty(config, "parent_column"),
+			orderBy:      getConfigProperty(config, "order_by"),
+			valueColumn:  getConfigProperty(config, "value_column"),
+		}
+		for key, value := range map[string]string{"property": join.property, TableName: join.name, "join_column": join.joinColumn} {
+			if value == "" {
+				return nil, fmt.Errorf("join %d needs a %s", i, key)
+			}
+		}
+		if join.parentColumn == "" {
+			var err error
+			if join.parentColumn, err = readKeyColumn(dsd); err != nil {
+				return nil, fmt.Errorf("join %d needs a parent_column: %w", i, err)
+			}
+		}
+		join.table = quoteTable(schema, join.name)
+		if mapping, found := config["outgoing_mapping_config"]; found {
+			data, err := json.Marshal(mapping)
+			if err == nil {
+				err = json.Unmarshal(data, &join.mapping)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("join %d: invalid outgoing_mapping_config: %w", i, err)
+			}
+		}
+		if (join.mapping == nil) == (join.valueColumn == "") {
+			return nil, fmt.Errorf("join %d needs either a value_column or an outgoing_mapping_config", i)
+		}
+		if join.mapping != nil && (join.mapping.MapAll || len(join.mapping.PropertyMappings) == 0) {
+			return nil, fmt.Errorf("join %d: the outgoing_mapping_config must list its property mappings, map_all is not supported", i)
+		}
+		joins = append(joins, join)
+	}
+	return joins, nil
+}
+
+// columns returns the columns read from the joined table.
+func (j joinTable) columns() []string {
+	if j.mapping == nil {
+		return []string{j.valueColumn}
+	}
+	var columns []string
+	seen := map[string]bool{}
+	for _, pm := range j.mapping.PropertyMappings {
+		if !seen[pm.Property] {
+			seen[pm.Property] = true
+			columns = append(columns, pm.Property)
+		}
+	}
+	return columns
+}
+
+// joinColumn returns the select expression aggregating the joined rows of a root row as a json
+// array of [order, row] pairs, where row is an object of the mapped columns, or the value of
+// the value column. tableName is the configured table of the root rows.
+func joinColumn(join joinTable, tableName string) string {
+	var sb strings.Builder
+	sb.WriteString("(SELECT JSON_ARRAYAGG(JSON_ARRAY(")
+	if join.orderBy != "" {
+		sb.WriteString("`j`.")
+		sb.WriteString(quoteIdentifier(join.orderBy))
+	} else {
+		sb.WriteString("NULL")
+	}
+	sb.WriteString(", ")
+	if join.mapping == nil {
+		sb.WriteString("`j`.")
+		sb.WriteString(quoteIdentifier(join.valueColumn))
+	} else {
+		sb.WriteString("JSON_OBJECT(")
+		for i, col := range join.columns() {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(quoteString(col))
+			sb.WriteString(", `j`.")
+			sb.WriteString(quoteIdentifier(col))
+		}
+		sb.WriteString(")")
+	}
+	sb.WriteString(")) FROM ")
+	sb.WriteString(join.table)
+	sb.WriteString(" AS `j` WHERE `j`.")
+	sb.WriteString(quoteIdentifier(join.joinColumn))
+	sb.WriteString(" = ")
+	sb.WriteString(quoteColumn(tableName, join.parentColumn))
+	sb.WriteString(") AS ")
+	sb.WriteString(quoteIdentifier(join.property))
+	return sb.String()
+}
+
+// quoteString returns a string literal for use in a statement.
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", "''") + "'"
+}
+
+// joinValues decodes an aggregated join column into the sub-entities, or the values, of the
+// joined rows in order.
+func joinValues(data []byte, join joinTable, mapper *cdl.Mapper) (any, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var pairs [][2]any
+	if err := decoder.Decode(&pairs); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return lessValue(pairs[i][0], pairs[j][0])
+	})
+
+	if join.mapping == nil {
+		values := make([]any, len(pairs))
+		for i, pair := range pairs {
+			values[i] = jsonValue(pair[1])
+		}
+		return values, nil
+	}
+	entities := make([]*egdm.Entity, 0, len(pairs))
+	for _, pair := range pairs {
+		row, ok := pair[1].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("joined row of %s is not an object", join.name)
+		}
+		item := &RowItem{Map: make(map[string]any, len(row))}
+		for _, col := range join.columns() {
+			item.Columns = append(item.Columns, col)
+			item.Map[col] = jsonValue(row[col])
+		}
+		entity := egdm.NewEntity()
+		if err := mapper.MapItemToEntity(item, entity); err != nil {
+			return nil, fmt.Errorf("failed to map joined row of %s: %w", join.name, err)
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+// jsonValue converts a decoded json number to an int64 or a float64, like column values are
+// read.
+func jsonValue(v any) any {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// lessValue orders the order_by values of joined rows, numbers before strings, nulls last.
+func lessValue(a, b any) bool {
+	if a == nil || b == nil {
+		return a != nil
+	}
+	an, aNumber := a.(json.Number)
+	bn, bNumber := b.(json.Number)
+	if aNumber && bNumber {
+		af, _ := an.Float64()
+		bf, _ := bn.Float64()
+		return af < bf
+	}
+	if aNumber != bNumber {
+		return aNumber
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
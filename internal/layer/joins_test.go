@@ -0,0 +1,97 @@
+package layer
+
+import (
+	"reflect"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func testJoinDefinition() *common.DatasetDefinition {
+	return &common.DatasetDefinition{
+		SourceConfig: map[string]any{
+			TableName: "order",
+			Joins: []any{
+				map[string]any{
+					"property":    "lines",
+					"table_name":  "order_line",
+					"join_column": "order_id",
+					"order_by":    "line_no",
+					"outgoing_mapping_config": map[string]any{
+						"base_uri": "http://data.test/",
+						"property_mappings": []any{
+							map[string]any{"property": "product", "entity_property": "product"},
+							map[string]any{"property": "quantity", "entity_property": "quantity"},
+						},
+					},
+				},
+				map[string]any{"property": "notes", "table_name": "order_note", "join_column": "order_id", "value_column": "text"},
+			},
+		},
+		OutgoingMappingConfig: &common.OutgoingMappingConfig{
+			BaseURI: "http://data.test/",
+			PropertyMappings: []*common.ItemToEntityPropertyMapping{
+				{Property: "id", IsIdentity: true, URIValuePattern: "http://data.test/orders/{value}"},
+				{Property: "lines", EntityProperty: "lines"},
+				{Property: "notes", EntityProperty: "notes"},
+			},
+		},
+	}
+}
+
+func TestJoins(t *testing.T) {
+	t.Run("Should aggregate joined rows in the root query", func(t *testing.T) {
+		q, err := buildQuery(testJoinDefinition(), "", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "SELECT `id`, " +
+			"(SELECT JSON_ARRAYAGG(JSON_ARRAY(`j`.`line_no`, JSON_OBJECT('product', `j`.`product`, 'quantity', `j`.`quantity`))) FROM `order_line` AS `j` WHERE `j`.`order_id` = `order`.`id`) AS `lines`, " +
+			"(SELECT JSON_ARRAYAGG(JSON_ARRAY(NULL, `j`.`text`)) FROM `order_note` AS `j` WHERE `j`.`order_id` = `order`.`id`) AS `notes` " +
+			"FROM `order`"
+		if q != expected {
+			t.Fatalf("Unexpected query:\n%s\nexpected:\n%s", q, expected)
+		}
+	})
+
+	t.Run("Should map joined rows to sub-entities in order", func(t *testing.T) {
+		joins, err := joinDefinitions(testJoinDefinition(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapper := common.NewMapper(common.NewLogger("test", "text", "error"), nil, joins[0].mapping)
+		values, err := joinValues([]byte(`[[2, {"product": "b", "quantity": 1}], [1, {"product": "a", "quantity": 12345678901234}]]`), joins[0], mapper)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entities, ok := values.([]*egdm.Entity)
+		if !ok || len(entities) != 2 {
+			t.Fatalf("Expected 2 sub-entities, got %v", values)
+		}
+		if entities[0].Properties["http://data.test/product"] != "a" || entities[0].Properties["http://data.test/quantity"] != int64(12345678901234) {
+			t.Fatalf("Unexpected first sub-entity %+v", entities[0].Properties)
+		}
+
+		values, err = joinValues([]byte(`[[null, "x"], [null, "y"]]`), joins[1], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, []any{"x", "y"}) {
+			t.Fatalf("Unexpected values %v", values)
+		}
+	})
+
+	t.Run("Should reject incomplete joins", func(t *testing.T) {
+		for _, join := range []map[string]any{
+			{"table_name": "order_line", "join_column": "order_id", "value_column": "text"},
+			{"property": "lines", "table_name": "order_line", "join_column": "order_id"},
+			{"property": "lines", "table_name": "order_line", "join_column": "order_id", "outgoing_mapping_config": map[string]any{"map_all": true}},
+		} {
+			_, err := joinDefinitions(&common.DatasetDefinition{SourceConfig: map[string]any{Joins: []any{join}}}, "")
+			if err == nil {
+				t.Errorf("Expected an error for %v", join)
+			}
+		}
+	})
+}
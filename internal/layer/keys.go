@@ -0,0 +1,177 @@
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+// rowKey identifies a row by the values of its key columns. id is a string form of the values,
+// used to dedupe a batch and to report the row.
+type rowKey struct {
+	id     string
+	values []any
+}
+
+func newRowKey(values []any) rowKey {
+	if len(values) == 1 {
+		return rowKey{id: fmt.Sprint(values[0]), values: values}
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	id, _ := json.Marshal(parts)
+	return rowKey{id: string(id), values: values}
+}
+
+// keyConfig returns the identity column, the optional identity_pattern and the key columns of
+// a dataset. Key columns are taken from key_columns, then from the named groups of
+// identity_pattern, then from the identity mappings, and default to id.
+func keyConfig(dsd *cdl.DatasetDefinition) (string, *regexp.Regexp, []string, error) {
+	idColumn := ""
+	var identities []string
+	if dsd.IncomingMappingConfig != nil {
+		for _, m := range dsd.IncomingMappingConfig.PropertyMappings {
+			if m.IsIdentity {
+				if idColumn == "" {
+					idColumn = m.Property
+				}
+				identities = append(identities, m.Property)
+			}
+		}
+	}
+	if idColumn == "" {
+		idColumn = "id"
+		identities = []string{idColumn}
+	}
+
+	var pattern *regexp.Regexp
+	var keys []string
+	if expr := getConfigProperty(dsd.SourceConfig, IdentityPattern); expr != "" {
+		var err error
+		pattern, err = regexp.Compile(expr)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("%s must be a regular expression: %w", IdentityPattern, err)
+		}
+		for _, name := range pattern.SubexpNames() {
+			if name != "" {
+				keys = append(keys, name)
+			}
+		}
+	}
+	if list, ok := dsd.SourceConfig[KeyColumns].([]any); ok {
+		keys = nil
+		for _, v := range list {
+			if name, ok := v.(string); ok {
+				keys = append(keys, name)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		keys = identities
+	}
+	return idColumn, pattern, keys, nil
+}
+
+// splitIdentity replaces the identity column of a row with the named groups of the
+// identity_pattern matched against it.
+func (o *MysqlWriter) splitIdentity(item *RowItem) error {
+	if o.identityPattern == nil {
+		return nil
+	}
+	value := fmt.Sprint(item.Map[o.idColumn])
+	match := o.identityPattern.FindStringSubmatch(value)
+	if match == nil {
+		return fmt.Errorf("identity %s does not match %s %s", value, IdentityPattern, o.identityPattern)
+	}
+	for i, col := range item.Columns {
+		if col == o.idColumn {
+			item.Columns = append(item.Columns[:i:i], item.Columns[i+1:]...)
+			item.Values = append(item.Values[:i:i], item.Values[i+1:]...)
+			delete(item.Map, o.idColumn)
+			break
+		}
+	}
+	for i, name := range o.identityPattern.SubexpNames() {
+		if name != "" {
+			item.SetValue(name, match[i])
+		}
+	}
+	return nil
+}
+
+// rowKey returns the key of a mapped and converted row, or an error if a key column is
+// missing. The id is built from the mapped values, the statement values are the converted ones.
+func (o *MysqlWriter) rowKey(item *RowItem) (rowKey, error) {
+	values := make([]any, len(o.keyColumns))
+	for i, col := range o.keyColumns {
+		value, found := item.Map[col]
+		if !found || value == nil {
+			return rowKey{}, fmt.Errorf("key column %s has no value", col)
+		}
+		values[i] = value
+	}
+	key := newRowKey(values)
+	for i, col := range o.keyColumns {
+		for c, name := range item.Columns {
+			if name == col {
+				key.values[i] = item.Values[c]
+			}
+		}
+	}
+	return key, nil
+}
+
+// keyMatch returns the condition matching rows by key, "`id` IN (?, ?)" for a single key
+// column, or "(`a`, `b`) IN ((?, ?), (?, ?))" for a composite key, with its arguments.
+func (o *MysqlWriter) keyMatch(keys []rowKey) (string, []any) {
+	var sb strings.Builder
+	composite := len(o.keyColumns) > 1
+	if composite {
+		sb.WriteString("(")
+	}
+	for i, col := range o.keyColumns {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(quoteIdentifier(applyColumnCase(o.columnCase, col)))
+	}
+	if composite {
+		sb.WriteString(")")
+	}
+	sb.WriteString(" IN (")
+	args := make([]any, 0, len(keys)*len(o.keyColumns))
+	for k, key := range keys {
+		if k > 0 {
+			sb.WriteString(", ")
+		}
+		if composite {
+			sb.WriteString("(")
+		}
+		for i, v := range key.values {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("?")
+			args = append(args, v)
+		}
+		if composite {
+			sb.WriteString(")")
+		}
+	}
+	sb.WriteString(")")
+	return sb.String(), args
+}
+
+// keySize estimates the bytes a key adds to a statement matching rows by key.
+func keySize(key rowKey) int {
+	size := 4
+	for _, v := range key.values {
+		size += argSize(v)
+	}
+	return size
+}
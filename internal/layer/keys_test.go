@@ -0,0 +1,109 @@
+package layer
+
+import (
+	"reflect"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestKeyConfig(t *testing.T) {
+	incoming := &common.IncomingMappingConfig{
+		BaseURI: "http://data.test/",
+		PropertyMappings: []*common.EntityToItemPropertyMapping{
+			{Property: "order_id", IsIdentity: true, StripReferencePrefix: true},
+			{Property: "line", EntityProperty: "line"},
+		},
+	}
+
+	t.Run("Should default to the identity column", func(t *testing.T) {
+		idColumn, pattern, keys, err := keyConfig(&common.DatasetDefinition{SourceConfig: map[string]any{}, IncomingMappingConfig: incoming})
+		if err != nil || idColumn != "order_id" || pattern != nil || !reflect.DeepEqual(keys, []string{"order_id"}) {
+			t.Fatalf("Unexpected key config %s %v %v %v", idColumn, pattern, keys, err)
+		}
+	})
+
+	t.Run("Should use key_columns over the identity", func(t *testing.T) {
+		_, _, keys, _ := keyConfig(&common.DatasetDefinition{SourceConfig: map[string]any{KeyColumns: []any{"order_id", "line"}}, IncomingMappingConfig: incoming})
+		if !reflect.DeepEqual(keys, []string{"order_id", "line"}) {
+			t.Fatalf("Unexpected keys %v", keys)
+		}
+	})
+
+	t.Run("Should use the named groups of identity_pattern", func(t *testing.T) {
+		_, pattern, keys, _ := keyConfig(&common.DatasetDefinition{SourceConfig: map[string]any{IdentityPattern: `^(?P<order>\w+)-(?P<line>\d+)$`}, IncomingMappingConfig: incoming})
+		if pattern == nil || !reflect.DeepEqual(keys, []string{"order", "line"}) {
+			t.Fatalf("Unexpected keys %v", keys)
+		}
+	})
+}
+
+func newKeyTestWriter(t *testing.T, sourceConfig map[string]any) *MysqlWriter {
+	incoming := &common.IncomingMappingConfig{
+		BaseURI: "http://data.test/",
+		PropertyMappings: []*common.EntityToItemPropertyMapping{
+			{Property: "id", IsIdentity: true, StripReferencePrefix: true},
+			{Property: "name", EntityProperty: "name"},
+		},
+	}
+	dsd := &common.DatasetDefinition{SourceConfig: sourceConfig, IncomingMappingConfig: incoming}
+	idColumn, pattern, keys, err := keyConfig(dsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWriter()
+	w.mapper = common.NewMapper(w.logger, incoming, nil)
+	w.idColumn = idColumn
+	w.identityPattern = pattern
+	w.keyColumns = keys
+	w.flushThreshold = 1000
+	w.batchRecorded = map[string]uint64{}
+	return w
+}
+
+func TestCompositeKeys(t *testing.T) {
+	t.Run("Should split the identity into key columns", func(t *testing.T) {
+		w := newKeyTestWriter(t, map[string]any{IdentityPattern: `^(?P<order>\w+)-(?P<line>\d+)$`})
+		entity := egdm.NewEntity().SetID("http://data.test/A17-2")
+		entity.SetProperty("http://data.test/name", "widget")
+		if err := w.Write(entity); err != nil {
+			t.Fatal(err)
+		}
+		row := w.batchInserts[`["A17","2"]`].RowItem
+		if row == nil || !reflect.DeepEqual(row.Columns, []string{"name", "order", "line"}) {
+			t.Fatalf("Unexpected row %+v", row)
+		}
+		stmt, args := w.deleteStatement(w.deleteKeys)
+		if stmt != "DELETE FROM `product` WHERE (`order`, `line`) IN ((?, ?))" || !reflect.DeepEqual(args, []any{"A17", "2"}) {
+			t.Fatalf("Unexpected delete %s %v", stmt, args)
+		}
+	})
+
+	t.Run("Should reject identities not matching the pattern", func(t *testing.T) {
+		w := newKeyTestWriter(t, map[string]any{IdentityPattern: `^(?P<order>\w+)-(?P<line>\d+)$`})
+		if err := w.Write(egdm.NewEntity().SetID("http://data.test/A17")); err == nil {
+			t.Fatalf("Expected an error")
+		}
+	})
+
+	t.Run("Should accept non-string keys and let a newer delete win", func(t *testing.T) {
+		w := newKeyTestWriter(t, map[string]any{KeyColumns: []any{"name"}})
+		entity := egdm.NewEntity().SetID("http://data.test/1")
+		entity.SetProperty("http://data.test/name", 42.0)
+		entity.Recorded = 1
+		if err := w.Write(entity); err != nil {
+			t.Fatal(err)
+		}
+		deleted := egdm.NewEntity().SetID("http://data.test/1")
+		deleted.SetProperty("http://data.test/name", 42.0)
+		deleted.IsDeleted = true
+		deleted.Recorded = 2
+		if err := w.Write(deleted); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.batchInserts) != 0 || len(w.deleteKeys) != 1 || w.deleteKeys[0].id != "42" {
+			t.Fatalf("Unexpected batch %v %v", w.batchInserts, w.deleteKeys)
+		}
+	})
+}
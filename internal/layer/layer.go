@@ -3,22 +3,34 @@ package layer
 import (
 	"context"
 	common "github.com/mimiro-io/common-datalayer"
+	"net/http"
 	"os"
 	"sort"
+	"sync"
 )
 
 type MysqlDatalayer struct {
+	// mu guards db and datasets, which are replaced together on every configuration reload
+	mu sync.RWMutex
+	// reloadMu serializes configuration reloads
+	reloadMu sync.Mutex
 	db       *MysqlDB
 	datasets map[string]*Dataset
 	config   *common.Config
 	logger   common.Logger
 	metrics  common.Metrics
+	stop     chan struct{}
+	stopOnce sync.Once
+	// serves the deep health report when health_port is configured
+	healthServer *http.Server
 }
 
 type Dataset struct {
 	logger            common.Logger
+	metrics           common.Metrics
 	db                *MysqlDB
 	datasetDefinition *common.DatasetDefinition
+	layer             *MysqlDatalayer
 }
 
 func (d *Dataset) MetaData() map[string]any {
@@ -30,7 +42,21 @@ func (d *Dataset) Name() string {
 }
 
 func (dl *MysqlDatalayer) Stop(ctx context.Context) error {
-	err := dl.db.db.Close()
+	dl.stopOnce.Do(func() {
+		close(dl.stop)
+	})
+	if dl.healthServer != nil {
+		err := dl.healthServer.Shutdown(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.db == nil {
+		return nil
+	}
+	err := dl.db.close()
 	if err != nil {
 		return err
 	}
@@ -39,6 +65,8 @@ func (dl *MysqlDatalayer) Stop(ctx context.Context) error {
 }
 
 func (dl *MysqlDatalayer) Dataset(dataset string) (common.Dataset, common.LayerError) {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
 	ds, found := dl.datasets[dataset]
 	if found {
 		return ds, nil
@@ -47,9 +75,19 @@ func (dl *MysqlDatalayer) Dataset(dataset string) (common.Dataset, common.LayerE
 }
 
 func (dl *MysqlDatalayer) DatasetDescriptions() []*common.DatasetDescription {
+	dl.mu.RLock()
+	var datasets []*Dataset
+	for _, ds := range dl.datasets {
+		datasets = append(datasets, ds)
+	}
+	dl.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), describeTimeout)
+	defer cancel()
+
 	var datasetDescriptions []*common.DatasetDescription
-	for key := range dl.datasets {
-		datasetDescriptions = append(datasetDescriptions, &common.DatasetDescription{Name: key})
+	for _, ds := range datasets {
+		datasetDescriptions = append(datasetDescriptions, ds.describe(ctx))
 	}
 	sort.Slice(datasetDescriptions, func(i, j int) bool {
 		return datasetDescriptions[i].Name < datasetDescriptions[j].Name
@@ -58,51 +96,47 @@ func (dl *MysqlDatalayer) DatasetDescriptions() []*common.DatasetDescription {
 }
 
 func NewMysqlDataLayer(conf *common.Config, logger common.Logger, metrics common.Metrics) (common.DataLayerService, error) {
-	mysqldb, err := newMysqlDB(conf)
-	if err != nil {
-		return nil, err
-	}
 	l := &MysqlDatalayer{
 		datasets: map[string]*Dataset{},
 		logger:   logger,
 		metrics:  metrics,
 		config:   conf,
-		db:       mysqldb,
+		stop:     make(chan struct{}),
 	}
-	err = l.UpdateConfiguration(conf)
+	err := l.UpdateConfiguration(conf)
 	if err != nil {
 		return nil, err
 	}
+	if l.db.conf.HealthPort != "" {
+		err = l.serveHealth(l.db.conf.HealthPort)
+		if err != nil {
+			_ = l.Stop(context.Background())
+			return nil, err
+		}
+	}
+	go l.watchCredentials(l.stop)
 	return l, nil
 }
 
+// EnrichConfig applies environment overrides to the loaded config. The fixed MYSQL_* variables
+// are applied first, then the generic MYSQL_SYSTEM_* and MYSQL_DATASET_* variables.
 func EnrichConfig(config *common.Config) error {
-	// read env for user and password
-	user := os.Getenv("MYSQL_USER")
-	password := os.Getenv("MYSQL_PASSWORD")
-	database := os.Getenv("MYSQL_DATABASE")
-	host := os.Getenv("MYSQL_HOST")
-	port := os.Getenv("MYSQL_PORT")
-
-	if user != "" {
-		config.NativeSystemConfig["user"] = user
+	if config.NativeSystemConfig == nil {
+		config.NativeSystemConfig = make(common.NativeSystemConfig)
 	}
 
-	if password != "" {
-		config.NativeSystemConfig["password"] = password
-	}
+	applyLegacyEnvOverrides(config, os.Getenv)
 
-	if database != "" {
-		config.NativeSystemConfig["database"] = database
-	}
+	return applyEnvOverrides(config, os.Environ())
+}
 
-	if host != "" {
-		config.NativeSystemConfig["host"] = host
+// incr records a metric tagged with the database address, if metrics are configured
+func (dl *MysqlDatalayer) incr(name string, address string) {
+	if dl.metrics == nil {
+		return
 	}
-
-	if port != "" {
-		config.NativeSystemConfig["port"] = port
+	err := dl.metrics.Incr(name, []string{"address:" + address}, 1)
+	if err != nil {
+		dl.logger.Warn("failed to record metric", "metric", name, "error", err)
 	}
-
-	return nil
 }
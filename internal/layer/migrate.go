@@ -0,0 +1,297 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+const migrateTimeout = 30 * time.Second
+
+// columnDefinition is a column the layer writes to, with the type used when the layer
+// creates it.
+type columnDefinition struct {
+	name    string
+	sqlType string
+}
+
+// columnType returns the column type for a property mapping datatype.
+func columnType(datatype string) (string, error) {
+	switch datatype {
+	case "", "string":
+		return "TEXT", nil
+	case "int", "integer":
+		return "INT", nil
+	case "long":
+		return "BIGINT", nil
+	case "float":
+		return "FLOAT", nil
+	case "double":
+		return "DOUBLE", nil
+	case "bool", "boolean":
+		return "BOOLEAN", nil
+	case "decimal":
+		return "DECIMAL(38,10)", nil
+	case "date":
+		return "DATE", nil
+	case "time":
+		return "TIME(6)", nil
+	case "datetime":
+		return "DATETIME", nil
+	case "timestamp":
+		return "TIMESTAMP NULL", nil
+	case "json", "list":
+		return "JSON", nil
+	case "uuid":
+		return "BINARY(16)", nil
+	case "base64":
+		return "BLOB", nil
+	default:
+		return "", fmt.Errorf("no column type for datatype %s", datatype)
+	}
+}
+
+// keyColumnType returns the column type for a key column. Keys must be indexable, so text is
+// limited in length.
+func keyColumnType(datatype string) (string, error) {
+	if datatype == "" || datatype == "string" {
+		return "VARCHAR(255)", nil
+	}
+	return columnType(datatype)
+}
+
+// tableDefinition derives the columns and key columns of a dataset's table from its incoming
+// mapping and source_config.
+func tableDefinition(dsd *cdl.DatasetDefinition) ([]columnDefinition, []string, error) {
+	if dsd.IncomingMappingConfig == nil {
+		return nil, nil, fmt.Errorf("an incoming_mapping_config is needed to derive the table")
+	}
+	idColumn, pattern, keys, err := keyConfig(dsd)
+	if err != nil {
+		return nil, nil, err
+	}
+	isKey := map[string]bool{}
+	for _, key := range keys {
+		isKey[key] = true
+	}
+
+	var columns []columnDefinition
+	seen := map[string]bool{}
+	add := func(name string, datatype string) error {
+		if seen[strings.ToLower(name)] {
+			return nil
+		}
+		seen[strings.ToLower(name)] = true
+		sqlType, err := columnType(datatype)
+		if isKey[name] {
+			sqlType, err = keyColumnType(datatype)
+		}
+		if err != nil {
+			return fmt.Errorf("column %s: %w", name, err)
+		}
+		columns = append(columns, columnDefinition{name: name, sqlType: sqlType})
+		return nil
+	}
+
+	if pattern != nil {
+		for _, name := range pattern.SubexpNames() {
+			if name != "" {
+				_ = add(name, "")
+			}
+		}
+	}
+	for _, pm := range dsd.IncomingMappingConfig.PropertyMappings {
+		if pattern != nil && pm.Property == idColumn {
+			// replaced by the groups of the identity pattern
+			continue
+		}
+		if childTableName(pm.Custom) != "" {
+			// stored in its own table
+			continue
+		}
+		datatype := pm.Datatype
+		if datatype == "list" && listDelimiter(pm) != "" {
+			datatype = "string"
+		}
+		if pm.IsRecorded {
+			datatype = "long"
+		} else if pm.IsDeleted {
+			datatype = "bool"
+		}
+		if err := add(pm.Property, datatype); err != nil {
+			return nil, nil, err
+		}
+	}
+	if entityColumn := getConfigProperty(dsd.SourceConfig, EntityColumn); entityColumn != "" && !seen[strings.ToLower(entityColumn)] {
+		seen[strings.ToLower(entityColumn)] = true
+		columns = append(columns, columnDefinition{name: entityColumn, sqlType: "JSON"})
+	}
+	if recordedColumn := getConfigProperty(dsd.SourceConfig, RecordedColumn); recordedColumn != "" && !seen[strings.ToLower(recordedColumn)] {
+		seen[strings.ToLower(recordedColumn)] = true
+		columns = append(columns, columnDefinition{name: recordedColumn, sqlType: "BIGINT UNSIGNED"})
+	}
+	if sinceColumn := getConfigProperty(dsd.SourceConfig, SinceColumn); sinceColumn != "" && !seen[strings.ToLower(sinceColumn)] {
+		precision := getConfigProperty(dsd.SourceConfig, SincePrecision)
+		if precision == "" {
+			precision = "6"
+		}
+		seen[strings.ToLower(sinceColumn)] = true
+		columns = append(columns, columnDefinition{name: sinceColumn, sqlType: "DATETIME(" + precision + ")"})
+	}
+
+	for _, key := range keys {
+		if !seen[strings.ToLower(key)] {
+			return nil, nil, fmt.Errorf("key column %s is not mapped", key)
+		}
+	}
+	return columns, keys, nil
+}
+
+// createTableStatement builds the CREATE TABLE statement for a derived table definition. Key
+// columns are not nullable and form the primary key, all other columns are nullable.
+func createTableStatement(table string, columnCase string, columns []columnDefinition, keys []string) string {
+	isKey := map[string]bool{}
+	for _, key := range keys {
+		isKey[key] = true
+	}
+	var sb strings.Builder
+	sb.WriteString("CREATE TABLE IF NOT EXISTS ")
+	sb.WriteString(table)
+	sb.WriteString(" (")
+	for i, c := range columns {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(quoteIdentifier(applyColumnCase(columnCase, c.name)))
+		sb.WriteString(" ")
+		sb.WriteString(c.sqlType)
+		if isKey[c.name] {
+			sb.WriteString(" NOT NULL")
+		}
+	}
+	sb.WriteString(", PRIMARY KEY (")
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(quoteIdentifier(applyColumnCase(columnCase, key)))
+	}
+	sb.WriteString("))")
+	return sb.String()
+}
+
+// createChildTableStatement builds the CREATE TABLE statement for the child table of a list
+// property, typed by the datatype of its items. parentType is the column type of the parent's
+// key column.
+func createChildTableStatement(child childTable, parentType string) (string, error) {
+	datatype := ""
+	if child.mapping != nil {
+		datatype = child.mapping.Datatype
+	}
+	sqlType, err := columnType(datatype)
+	if err != nil {
+		return "", fmt.Errorf("column %s: %w", child.property, err)
+	}
+	return "CREATE TABLE IF NOT EXISTS " + child.table +
+		" (`parent_id` " + strings.TrimSuffix(parentType, " NULL") + " NOT NULL, `ordinal` INT NOT NULL, `value` " + sqlType +
+		", PRIMARY KEY (`parent_id`, `ordinal`))", nil
+}
+
+// addColumnStatement builds the statement adding a missing column. Added columns are always
+// nullable, so existing rows stay valid.
+func addColumnStatement(table string, columnCase string, c columnDefinition) string {
+	return "ALTER TABLE " + table + " ADD COLUMN " + quoteIdentifier(applyColumnCase(columnCase, c.name)) + " " + c.sqlType
+}
+
+// migrate creates or migrates the dataset's table and the tables of its routes.
+func (d *Dataset) migrate(ctx context.Context) error {
+	if d.datasetDefinition.IncomingMappingConfig != nil {
+		if err := d.migrateTable(ctx); err != nil {
+			return err
+		}
+	}
+	datasets, _, err := d.routeDatasets()
+	if err != nil {
+		return err
+	}
+	for _, ds := range datasets {
+		if err := ds.migrateTable(ctx); err != nil {
+			return fmt.Errorf("route to %s: %w", getConfigProperty(ds.datasetDefinition.SourceConfig, TableName), err)
+		}
+	}
+	return nil
+}
+
+// migrateTable creates the dataset's table if it is missing and auto_create_table is set, and
+// adds missing columns if auto_migrate is set. Existing columns are never dropped or changed.
+func (d *Dataset) migrateTable(ctx context.Context) error {
+	sourceConfig := d.datasetDefinition.SourceConfig
+	autoCreate := sourceConfig[AutoCreateTable] == true
+	autoMigrate := sourceConfig[AutoMigrate] == true
+	if !autoCreate && !autoMigrate {
+		return nil
+	}
+
+	tableName := getConfigProperty(sourceConfig, TableName)
+	columns, keys, err := tableDefinition(d.datasetDefinition)
+	if err != nil {
+		return err
+	}
+	existing, err := d.tableColumns(ctx, tableName)
+	if err != nil {
+		return fmt.Errorf("could not read columns of table %s: %w", tableName, err)
+	}
+	table := quoteTable(d.db.conf.Schema, tableName)
+	colCase := columnCase(d.datasetDefinition)
+
+	if autoCreate {
+		parentType := "VARCHAR(255)"
+		for _, c := range columns {
+			if len(keys) == 1 && c.name == keys[0] {
+				parentType = c.sqlType
+			}
+		}
+		for _, child := range incomingChildTables(d.datasetDefinition, d.db.conf.Schema) {
+			stmt, err := createChildTableStatement(child, parentType)
+			if err != nil {
+				return err
+			}
+			d.logger.Debug(stmt)
+			if _, err := d.db.db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("could not create child table %s: %w", child.table, err)
+			}
+		}
+	}
+
+	if len(existing) == 0 {
+		if !autoCreate {
+			return fmt.Errorf("table %s does not exist", tableName)
+		}
+		stmt := createTableStatement(table, colCase, columns, keys)
+		d.logger.Info("creating table", "dataset", d.Name(), "table", tableName)
+		d.logger.Debug(stmt)
+		if _, err := d.db.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("could not create table %s: %w", tableName, err)
+		}
+		return nil
+	}
+
+	if !autoMigrate {
+		return nil
+	}
+	for _, c := range columns {
+		if _, found := findColumn(existing, applyColumnCase(colCase, c.name)); found {
+			continue
+		}
+		stmt := addColumnStatement(table, colCase, c)
+		d.logger.Info("adding column", "dataset", d.Name(), "table", tableName, "column", c.name)
+		d.logger.Debug(stmt)
+		if _, err := d.db.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("could not add column %s to table %s: %w", c.name, tableName, err)
+		}
+	}
+	return nil
+}
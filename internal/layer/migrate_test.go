@@ -0,0 +1,74 @@
+package layer
+
+import (
+	"reflect"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestTableDefinition(t *testing.T) {
+	dsd := &common.DatasetDefinition{
+		SourceConfig: map[string]any{
+			TableName:       "order_line",
+			SinceColumn:     "updated",
+			SincePrecision:  "3",
+			RecordedColumn:  "recorded",
+			IdentityPattern: `^(?P<order_id>\w+)-(?P<line_no>\d+)$`,
+		},
+		IncomingMappingConfig: &common.IncomingMappingConfig{
+			PropertyMappings: []*common.EntityToItemPropertyMapping{
+				{Property: "id", IsIdentity: true},
+				{Property: "quantity", Datatype: "int"},
+				{Property: "shipped", Datatype: "datetime"},
+				{Property: "note"},
+			},
+		},
+	}
+
+	t.Run("Should derive columns and keys from the mapping", func(t *testing.T) {
+		columns, keys, err := tableDefinition(dsd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []columnDefinition{
+			{name: "order_id", sqlType: "VARCHAR(255)"},
+			{name: "line_no", sqlType: "VARCHAR(255)"},
+			{name: "quantity", sqlType: "INT"},
+			{name: "shipped", sqlType: "DATETIME"},
+			{name: "note", sqlType: "TEXT"},
+			{name: "recorded", sqlType: "BIGINT UNSIGNED"},
+			{name: "updated", sqlType: "DATETIME(3)"},
+		}
+		if !reflect.DeepEqual(columns, expected) {
+			t.Fatalf("Unexpected columns %v", columns)
+		}
+		if !reflect.DeepEqual(keys, []string{"order_id", "line_no"}) {
+			t.Fatalf("Unexpected keys %v", keys)
+		}
+	})
+
+	t.Run("Should build create and alter statements", func(t *testing.T) {
+		columns := []columnDefinition{{name: "Id", sqlType: "VARCHAR(255)"}, {name: "Name", sqlType: "TEXT"}}
+		stmt := createTableStatement("`product`", ColumnCaseLower, columns, []string{"Id"})
+		if stmt != "CREATE TABLE IF NOT EXISTS `product` (`id` VARCHAR(255) NOT NULL, `name` TEXT, PRIMARY KEY (`id`))" {
+			t.Fatalf("Unexpected statement %s", stmt)
+		}
+		stmt = addColumnStatement("`product`", ColumnCasePreserve, columns[1])
+		if stmt != "ALTER TABLE `product` ADD COLUMN `Name` TEXT" {
+			t.Fatalf("Unexpected statement %s", stmt)
+		}
+	})
+
+	t.Run("Should reject unknown datatypes", func(t *testing.T) {
+		_, _, err := tableDefinition(&common.DatasetDefinition{
+			SourceConfig: map[string]any{},
+			IncomingMappingConfig: &common.IncomingMappingConfig{
+				PropertyMappings: []*common.EntityToItemPropertyMapping{{Property: "id", IsIdentity: true}, {Property: "x", Datatype: "complex"}},
+			},
+		})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+	})
+}
@@ -2,30 +2,40 @@ package layer
 
 import (
 	"database/sql"
-	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
 	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
 )
 
+// poolDrainTimeout bounds how long a retired pool waits for in-flight iterators and
+// writers before it is closed anyway. It protects against writers that are never closed.
+const poolDrainTimeout = 30 * time.Minute
+
+var errPoolClosed = errors.New("connection pool is closed")
+
+// MysqlDB wraps a connection pool and tracks the iterators and writers using it,
+// so that a pool replaced by a configuration reload is only closed once they are done.
 type MysqlDB struct {
-	db *sql.DB
+	db      *sql.DB
+	conf    *MysqlConf
+	address string
+	mu      sync.Mutex
+	inUse   int
+	retired bool
+	closed  bool
+	drained chan struct{}
+	// max_allowed_packet of the server, generated statements must stay below it
+	maxPacket int
 }
 
-func newMysqlDB(conf *common.Config) (*MysqlDB, error) {
-	c, err := newMysqlConf(conf)
-	if err != nil {
-		return nil, err
-	}
-	connStr := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?parseTime=true&multiStatements=true",
-		c.User,
-		c.Password,
-		c.Hostname,
-		c.Port,
-		c.Database,
-	)
-
-	db, cerr := sql.Open("mysql", connStr)
+func newMysqlDB(c *MysqlConf, address string) (*MysqlDB, error) {
+	db, cerr := sql.Open("mysql", c.dsn(address))
 	if cerr != nil {
 		return nil, ErrConnection(cerr)
 	}
@@ -33,10 +43,123 @@ func newMysqlDB(conf *common.Config) (*MysqlDB, error) {
 	// Ping the database to verify DSN provided by the user.
 	perr := db.Ping()
 	if perr != nil {
+		db.Close()
 		return nil, ErrConnection(perr)
 	}
 
-	return &MysqlDB{db}, nil
+	maxPacket := defaultMaxPacket
+	if err := db.QueryRow("SELECT @@max_allowed_packet").Scan(&maxPacket); err != nil {
+		maxPacket = defaultMaxPacket
+	}
+
+	return &MysqlDB{db: db, conf: c, address: address, maxPacket: maxPacket, drained: make(chan struct{})}, nil
+}
+
+// connect tries the configured addresses in order and returns a pool for the first one that
+// answers. When skip is set, the addresses after it are tried first and skip itself last.
+func (dl *MysqlDatalayer) connect(c *MysqlConf, skip string) (*MysqlDB, error) {
+	addresses := c.addresses()
+	for i, address := range addresses {
+		if address == skip {
+			rotated := make([]string, 0, len(addresses))
+			rotated = append(rotated, addresses[i+1:]...)
+			addresses = append(rotated, addresses[:i+1]...)
+			break
+		}
+	}
+
+	var errs []error
+	for _, address := range addresses {
+		db, err := newMysqlDB(c, address)
+		if err != nil {
+			dl.logger.Warn("failed to connect to database", "address", address, "error", err)
+			dl.incr("mysql.connect.failed", address)
+			errs = append(errs, err)
+			continue
+		}
+		dl.logger.Info("connected to database", "address", address, "database", c.Database, "max_allowed_packet", db.maxPacket)
+		dl.incr("mysql.connect.active", address)
+		return db, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// isConnectionError reports whether err, possibly wrapped in a LayerError, means the server
+// could not be reached or the connection broke.
+func isConnectionError(err error) bool {
+	if lerr, ok := err.(common.LayerError); ok {
+		err = lerr.Underlying()
+	}
+	var opErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &opErr)
+}
+
+// acquire registers a user of the pool. Every successful acquire must be paired with release.
+func (m *MysqlDB) acquire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrConnection(errPoolClosed)
+	}
+	m.inUse++
+	return nil
+}
+
+func (m *MysqlDB) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inUse--
+	if m.retired && m.inUse == 0 {
+		m.signalDrained()
+	}
+}
+
+// signalDrained must be called with m.mu held
+func (m *MysqlDB) signalDrained() {
+	select {
+	case <-m.drained:
+	default:
+		close(m.drained)
+	}
+}
+
+// retire closes the pool in the background once all current users have released it,
+// or when poolDrainTimeout has passed.
+func (m *MysqlDB) retire(logger common.Logger) {
+	m.mu.Lock()
+	m.retired = true
+	if m.inUse == 0 {
+		m.signalDrained()
+	}
+	m.mu.Unlock()
+
+	go func() {
+		select {
+		case <-m.drained:
+		case <-time.After(poolDrainTimeout):
+			logger.Warn("closing retired connection pool with users still active", "in_use", m.usage())
+		}
+		if err := m.close(); err != nil {
+			logger.Error("failed to close retired connection pool", "error", err)
+		}
+	}()
+}
+
+func (m *MysqlDB) usage() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inUse
+}
+
+func (m *MysqlDB) close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+	return m.db.Close()
 }
 
 type RowItem struct {
@@ -81,6 +204,12 @@ func (r *RowItem) GetValue(name string) any {
 		} else {
 			return nil
 		}
+	case []any, []string, []*egdm.Entity:
+		// list properties read from child tables, and sub-entities read from joined tables
+		return v
+	case string, bool, int64, float64, map[string]any:
+		// values of joined rows, decoded from json
+		return v
 	case nil:
 		return nil
 	default:
@@ -0,0 +1,59 @@
+package layer
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func newTestPool(t *testing.T) *MysqlDB {
+	// sql.Open does not connect, so this works without a running server
+	db, err := sql.Open("mysql", "user:pass@tcp(localhost:1)/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MysqlDB{db: db, drained: make(chan struct{})}
+}
+
+func TestMysqlDBRetire(t *testing.T) {
+	logger := common.NewLogger("test", "text", "error")
+
+	t.Run("Should close a retired pool once all users have released it", func(t *testing.T) {
+		pool := newTestPool(t)
+		if err := pool.acquire(); err != nil {
+			t.Fatal(err)
+		}
+		pool.retire(logger)
+
+		time.Sleep(50 * time.Millisecond)
+		pool.mu.Lock()
+		closed := pool.closed
+		pool.mu.Unlock()
+		if closed {
+			t.Fatalf("Expected pool to stay open while in use")
+		}
+
+		pool.release()
+		select {
+		case <-pool.drained:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected pool to be drained after release")
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := pool.acquire(); err == nil {
+			t.Fatalf("Expected acquire on a closed pool to fail")
+		}
+	})
+
+	t.Run("Should close an unused pool right away", func(t *testing.T) {
+		pool := newTestPool(t)
+		pool.retire(logger)
+		select {
+		case <-pool.drained:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected unused pool to be drained")
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package layer
+
+import "fmt"
+
+const (
+	// the mysql 5.7 default, used when the server limit cannot be read
+	defaultMaxPacket = 4 << 20
+	// room left in a packet for the statement text around the values
+	statementOverhead = 4 << 10
+)
+
+// argSize estimates how many bytes an argument takes once the driver interpolates it into
+// the statement. Strings are counted as if every character needs escaping.
+func argSize(v any) int {
+	switch v := v.(type) {
+	case nil:
+		return len("NULL") + 2
+	case string:
+		return 2*len(v) + 4
+	case []byte:
+		return 2*len(v) + len("_binary''") + 2
+	default:
+		return 32
+	}
+}
+
+// rowSize estimates the bytes a row adds to an insert statement.
+func (o *MysqlWriter) rowSize(item *RowItem) int {
+	size := len("(), NOW(6)")
+	for _, val := range item.Values {
+		size += argSize(val)
+	}
+	if o.recordedColumn != "" {
+		size += argSize(uint64(0))
+	}
+	return size
+}
+
+// checkRowSize returns an error if a row cannot be written in a single statement.
+func (o *MysqlWriter) checkRowSize(id string, size int) error {
+	if o.statementLimit > 0 && size > o.statementLimit {
+		return fmt.Errorf("entity %s needs up to %d bytes, more than the %d bytes max_allowed_packet allows", id, size, o.statementLimit+statementOverhead)
+	}
+	return nil
+}
+
+// chunkRows splits rows so the estimated size of each chunk stays within the statement limit.
+func (o *MysqlWriter) chunkRows(rows []EntityInsert) [][]EntityInsert {
+	if o.statementLimit <= 0 {
+		return [][]EntityInsert{rows}
+	}
+	var chunks [][]EntityInsert
+	start, size := 0, 0
+	for i, row := range rows {
+		rs := o.rowSize(row.RowItem)
+		if i > start && size+rs > o.statementLimit {
+			chunks = append(chunks, rows[start:i])
+			start, size = i, 0
+		}
+		size += rs
+	}
+	return append(chunks, rows[start:])
+}
+
+// chunkKeys splits keys so the estimated size of each statement matching them stays within
+// the limit.
+func (o *MysqlWriter) chunkKeys(keys []rowKey) [][]rowKey {
+	return o.chunkKeysBy(keys, keySize)
+}
+
+// chunkKeysBy splits keys like chunkKeys, with the bytes a key adds to the statement estimated
+// by size.
+func (o *MysqlWriter) chunkKeysBy(keys []rowKey, size func(rowKey) int) [][]rowKey {
+	if o.statementLimit <= 0 {
+		return [][]rowKey{keys}
+	}
+	var chunks [][]rowKey
+	start, total := 0, 0
+	for i, key := range keys {
+		ks := size(key)
+		if i > start && total+ks > o.statementLimit {
+			chunks = append(chunks, keys[start:i])
+			start, total = i, 0
+		}
+		total += ks
+	}
+	return append(chunks, keys[start:])
+}
@@ -22,6 +22,14 @@ func (d *Dataset) Changes(since string, limit int, latestOnly bool) (cdl.EntityI
 
 	mapper := cdl.NewMapper(d.logger, d.datasetDefinition.IncomingMappingConfig, d.datasetDefinition.OutgoingMappingConfig)
 	iter, err := d.newIterator(mapper, since, limit)
+	if err != nil && d.layer != nil {
+		// credentials may have been rotated or the host may be gone, retry once on a fresh pool
+		if ds := d.layer.reconnectDataset(d, err); ds != nil {
+			d.logger.Info("retrying read on a new connection pool", "dataset", d.Name(), "error", err)
+			mapper = cdl.NewMapper(ds.logger, ds.datasetDefinition.IncomingMappingConfig, ds.datasetDefinition.OutgoingMappingConfig)
+			iter, err = ds.newIterator(mapper, since, limit)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -48,10 +56,21 @@ func getConfigProperty(config map[string]interface{}, key string) string {
 }
 
 func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbIterator, cdl.LayerError) {
-	entityColumn := getConfigProperty(d.datasetDefinition.SourceConfig, EntityColumn)
+	colCase := columnCase(d.datasetDefinition)
+	entityColumn := applyColumnCase(colCase, getConfigProperty(d.datasetDefinition.SourceConfig, EntityColumn))
 	sinceCol := getConfigProperty(d.datasetDefinition.SourceConfig, SinceColumn)
 	ctx := context.Background() // no timeout because we want to support long running stream operations
 
+	// hold on to the pool until the iterator is closed, so a configuration reload does not close it underneath us
+	if err := d.db.acquire(); err != nil {
+		return nil, cdl.Err(err, cdl.LayerErrorInternal)
+	}
+	acquired := true
+	defer func() {
+		if acquired {
+			d.db.release()
+		}
+	}()
 	db := d.db.db
 
 	var maxSince sql.NullTime
@@ -60,11 +79,11 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 		// since table
 		sinceTable := getConfigProperty(d.datasetDefinition.SourceConfig, SinceTable)
 		if sinceTable == "" {
-			sinceTable = d.datasetDefinition.SourceConfig[TableName].(string)
+			sinceTable = getConfigProperty(d.datasetDefinition.SourceConfig, TableName)
 		}
 
 		// build max since query
-		maxSinceQuery := "SELECT MAX(" + sinceCol + ") AS \"_MAX_SINCE\" FROM " + sinceTable
+		maxSinceQuery := "SELECT MAX(" + quoteIdentifier(sinceCol) + ") AS \"_MAX_SINCE\" FROM " + quoteTable(d.db.conf.Schema, sinceTable)
 		rows, err := db.QueryContext(ctx, maxSinceQuery)
 		if err != nil {
 			return nil, cdl.Err(err, cdl.LayerErrorInternal)
@@ -95,8 +114,21 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 		maxSinceStr = maxSince.Time.Format("2006-01-02 15:04:05.000000")
 	}
 
+	definition := d.datasetDefinition
+	var replaced []string
+	if definition.SourceConfig[ForeignKeyRefs] == true {
+		// foreign keys may change without a configuration reload, so they are looked up per read
+		var err error
+		definition, replaced, err = d.withForeignKeyReferences(ctx)
+		if err != nil {
+			d.logger.Error("failed to read foreign keys", "error", err)
+			return nil, ErrQuery(err)
+		}
+		mapper = cdl.NewMapper(d.logger, definition.IncomingMappingConfig, definition.OutgoingMappingConfig)
+	}
+
 	// build the query
-	query, err := buildQuery(d.datasetDefinition, since, maxSinceStr, limit)
+	query, err := buildQuery(definition, d.db.conf.Schema, since, maxSinceStr, limit)
 	d.logger.Debug(fmt.Sprintf("changes query for dataset %s: %s", d.Name(), query), "dataset", d.Name())
 	if err != nil {
 		d.logger.Error("failed to build query", "error", err)
@@ -119,9 +151,8 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 		return nil, ErrQuery(err)
 	}
 
-	// lower case all the columne
 	for i, col := range columns {
-		columns[i] = strings.ToLower(col)
+		columns[i] = applyColumnCase(colCase, col)
 	}
 
 	rowBuf := make([]any, 0, len(cts))
@@ -156,7 +187,29 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 		}
 	}
 
+	// child columns are aggregated json, decoded into lists when rows are read
+	children := map[string]bool{}
+	for _, child := range outgoingChildTables(d.datasetDefinition, d.db.conf.Schema) {
+		children[applyColumnCase(colCase, child.property)] = child.reference
+	}
+
+	// joined tables are aggregated json too, decoded into sub-entities or lists
+	joins := map[string]*joinReader{}
+	joinTables, err := joinDefinitions(d.datasetDefinition, d.db.conf.Schema)
+	if err != nil {
+		rows.Close()
+		return nil, ErrQuery(err)
+	}
+	for _, join := range joinTables {
+		joins[applyColumnCase(colCase, join.property)] = &joinReader{
+			join:   join,
+			mapper: cdl.NewMapper(d.logger, nil, join.mapping),
+		}
+	}
+
+	acquired = false
 	return &dbIterator{
+		pool:         d.db,
 		logger:       d.logger,
 		since:        since,
 		limit:        limit,
@@ -168,14 +221,31 @@ func (d *Dataset) newIterator(mapper *cdl.Mapper, since string, limit int) (*dbI
 		rowBuf:       rowBuf,
 		sinceColumn:  sinceCol,
 		entityColumn: entityColumn,
+		children:     children,
+		joins:        joins,
+		replaced:     replaced,
 	}, nil
 }
 
-func buildQuery(definition *cdl.DatasetDefinition, since string, maxSince string, limit int) (string, error) {
+// buildQuery builds the read query for a dataset. schema qualifies table_name unless it carries
+// its own schema.
+func buildQuery(definition *cdl.DatasetDefinition, schema string, since string, maxSince string, limit int) (string, error) {
 	entityColumn := getConfigProperty(definition.SourceConfig, EntityColumn)
 	sinceColumn := getConfigProperty(definition.SourceConfig, SinceColumn)
 	sinceTable := getConfigProperty(definition.SourceConfig, SinceTable)
 	dataQuery := getConfigProperty(definition.SourceConfig, DataQuery)
+	children := outgoingChildTables(definition, schema)
+	joins, err := joinDefinitions(definition, schema)
+	if err != nil {
+		return "", err
+	}
+	isChild := map[string]bool{}
+	for _, child := range children {
+		isChild[child.property] = true
+	}
+	for _, join := range joins {
+		isChild[join.property] = true
+	}
 	cols := "*"
 	if definition.OutgoingMappingConfig == nil {
 		if entityColumn != "" {
@@ -187,24 +257,58 @@ func buildQuery(definition *cdl.DatasetDefinition, since string, maxSince string
 		if !definition.OutgoingMappingConfig.MapAll {
 			cols = ""
 			for _, pm := range definition.OutgoingMappingConfig.PropertyMappings {
+				if isChild[pm.Property] {
+					continue
+				}
 				if len(cols) > 0 {
 					cols = cols + ", "
 				}
-				cols = cols + pm.Property
+				cols = cols + quoteIdentifier(pm.Property)
+			}
+		}
+	}
+	if len(children) > 0 || len(joins) > 0 {
+		// list properties are aggregated from their child and joined tables
+		if dataQuery != "" {
+			return "", fmt.Errorf("child and joined tables cannot be read with a %s", DataQuery)
+		}
+		tableName := getConfigProperty(definition.SourceConfig, TableName)
+		if cols == "*" {
+			_, table := splitTableName(tableName)
+			cols = quoteIdentifier(table) + ".*"
+		}
+		if len(children) > 0 {
+			keyColumn, err := readKeyColumn(definition)
+			if err != nil {
+				return "", err
+			}
+			parentKey := quoteColumn(tableName, keyColumn)
+			for _, child := range children {
+				if len(cols) > 0 {
+					cols = cols + ", "
+				}
+				cols = cols + childColumn(child, parentKey)
+			}
+		}
+		for _, join := range joins {
+			if len(cols) > 0 {
+				cols = cols + ", "
 			}
+			cols = cols + joinColumn(join, tableName)
 		}
 	}
 	var q string
 	if dataQuery != "" {
 		q = dataQuery
 	} else {
-		q = "SELECT " + cols + " FROM " + definition.SourceConfig[TableName].(string)
+		q = "SELECT " + cols + " FROM " + quoteTable(schema, getConfigProperty(definition.SourceConfig, TableName))
 	}
 
 	if maxSince != "" {
 		if sinceTable != "" {
+			// only a custom data query can have a where clause of its own
 			connectTerm := " AND "
-			if !strings.Contains(q, "WHERE") {
+			if dataQuery == "" || !strings.Contains(q, "WHERE") {
 				connectTerm = " WHERE "
 			}
 
@@ -214,14 +318,14 @@ func buildQuery(definition *cdl.DatasetDefinition, since string, maxSince string
 					return "", err
 				}
 
-				term := connectTerm + " %s.%s > '%s' AND %s.%s <= '%s'"
+				term := connectTerm + " %s > '%s' AND %s <= '%s'"
 				q += fmt.Sprintf(term,
-					sinceTable, sinceColumn, sinceValStr,
-					sinceTable, sinceColumn, maxSince)
+					quoteColumn(sinceTable, sinceColumn), sinceValStr,
+					quoteColumn(sinceTable, sinceColumn), maxSince)
 			} else {
-				term := connectTerm + " %s.%s <= '%s'"
+				term := connectTerm + " %s <= '%s'"
 				q += fmt.Sprintf(term,
-					sinceTable, sinceColumn, maxSince)
+					quoteColumn(sinceTable, sinceColumn), maxSince)
 			}
 		} else if sinceColumn != "" {
 			if since != "" {
@@ -230,12 +334,13 @@ func buildQuery(definition *cdl.DatasetDefinition, since string, maxSince string
 					return "", err
 				}
 
-				q += fmt.Sprintf(" WHERE %s.%s > '%s' AND %s.%s <= '%s'",
-					definition.SourceConfig[TableName], definition.SourceConfig[SinceColumn], sinceValStr,
-					definition.SourceConfig[TableName], definition.SourceConfig[SinceColumn], maxSince)
+				sinceRef := quoteColumn(getConfigProperty(definition.SourceConfig, TableName), sinceColumn)
+				q += fmt.Sprintf(" WHERE %s > '%s' AND %s <= '%s'",
+					sinceRef, sinceValStr,
+					sinceRef, maxSince)
 			} else {
-				q += fmt.Sprintf(" WHERE %s.%s <= '%s'",
-					definition.SourceConfig[TableName], definition.SourceConfig[SinceColumn], maxSince)
+				q += fmt.Sprintf(" WHERE %s <= '%s'",
+					quoteColumn(getConfigProperty(definition.SourceConfig, TableName), sinceColumn), maxSince)
 			}
 		}
 	}
@@ -246,6 +351,7 @@ func buildQuery(definition *cdl.DatasetDefinition, since string, maxSince string
 }
 
 type dbIterator struct {
+	pool         *MysqlDB
 	logger       cdl.Logger
 	mapper       *cdl.Mapper
 	rows         *sql.Rows
@@ -257,6 +363,18 @@ type dbIterator struct {
 	limit        int
 	sinceColumn  string
 	entityColumn string
+	// child table columns, and whether they hold references
+	children map[string]bool
+	// joined table columns
+	joins map[string]*joinReader
+	// properties of map_all replaced by foreign key references
+	replaced []string
+}
+
+// joinReader decodes the column of a joined table with the join's own mapping.
+type joinReader struct {
+	join   joinTable
+	mapper *cdl.Mapper
 }
 
 func (it *dbIterator) Context() *egdm.Context {
@@ -282,7 +400,21 @@ func (it *dbIterator) Next() (*egdm.Entity, cdl.LayerError) {
 				Map: make(map[string]any),
 			}
 			for i, col := range it.columns {
-				ri.Map[strings.ToLower(col)] = it.rowBuf[i]
+				ri.Map[col] = it.rowBuf[i]
+				if reference, found := it.children[col]; found {
+					ri.Map[col], err = childValues(rawColumn(it.rowBuf[i]), reference)
+					if err != nil {
+						it.logger.Error("failed to decode child rows", "error", err, "column", col)
+						return nil, cdl.Err(err, cdl.LayerErrorInternal)
+					}
+				}
+				if jr, found := it.joins[col]; found {
+					ri.Map[col], err = joinValues(rawColumn(it.rowBuf[i]), jr.join, jr.mapper)
+					if err != nil {
+						it.logger.Error("failed to decode joined rows", "error", err, "column", col)
+						return nil, cdl.Err(err, cdl.LayerErrorInternal)
+					}
+				}
 			}
 
 			err = it.mapper.MapItemToEntity(ri, entity)
@@ -290,6 +422,9 @@ func (it *dbIterator) Next() (*egdm.Entity, cdl.LayerError) {
 				it.logger.Error("failed to map row", "error", err, "row", fmt.Sprintf("%+v", ri))
 				return nil, cdl.Err(err, cdl.LayerErrorInternal)
 			}
+			for _, property := range it.replaced {
+				delete(entity.Properties, property)
+			}
 		} else {
 			// read the entity column
 			data := ""
@@ -305,32 +440,11 @@ func (it *dbIterator) Next() (*egdm.Entity, cdl.LayerError) {
 				}
 			}
 
-			// parse this into an entity
-			parser := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs()
-
-			// add context to the entity json
-			data = fmt.Sprintf("[{\"id\" : \"@context\", \"namespaces\" : {} }, %s ]", data)
-
-			// create a reader from the data varaible
-			datastream := strings.NewReader(data)
-
-			err = parser.Parse(datastream, func(ent *egdm.Entity) error {
-				entity = ent
-				return nil
-			}, func(continuation *egdm.Continuation) {
-
-			})
-
+			entity, err = parseEntityColumn(data)
 			if err != nil {
 				it.logger.Error("failed to parse entity", "error", err)
 				return nil, cdl.Err(err, cdl.LayerErrorInternal)
 			}
-
-			if entity == nil {
-				it.logger.Error("failed to parse entity", "error", "no entity")
-				return nil, cdl.Err(fmt.Errorf("no entity"), cdl.LayerErrorInternal)
-			}
-
 		}
 
 		return entity, nil
@@ -354,9 +468,47 @@ func (it *dbIterator) Token() (*egdm.Continuation, cdl.LayerError) {
 }
 
 func (it *dbIterator) Close() cdl.LayerError {
+	if it.pool != nil {
+		defer it.pool.release()
+		it.pool = nil
+	}
 	err := it.rows.Close()
 	if err != nil {
 		return cdl.Err(err, cdl.LayerErrorInternal)
 	}
 	return nil
 }
+
+// rawColumn returns the bytes of a scanned json column.
+func rawColumn(v any) []byte {
+	switch v := v.(type) {
+	case *json.RawMessage:
+		return *v
+	case *sql.NullString:
+		return []byte(v.String)
+	}
+	return nil
+}
+
+// parseEntityColumn parses the json of an entity column into an entity.
+func parseEntityColumn(data string) (*egdm.Entity, error) {
+	parser := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs()
+
+	// add context to the entity json
+	data = fmt.Sprintf("[{\"id\" : \"@context\", \"namespaces\" : {} }, %s ]", data)
+
+	var entity *egdm.Entity
+	err := parser.Parse(strings.NewReader(data), func(ent *egdm.Entity) error {
+		entity = ent
+		return nil
+	}, func(continuation *egdm.Continuation) {
+
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("no entity")
+	}
+	return entity, nil
+}
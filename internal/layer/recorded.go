@@ -0,0 +1,106 @@
+package layer
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// staleIds returns the ids of the batch whose stored row has a newer recorded value than the
+// incoming entity. The rows are locked until the transaction ends, so a concurrent writer
+// cannot slip a newer version in between the check and the write. This is why a recorded
+// column cannot be combined with transaction_scope none.
+func (o *MysqlWriter) staleIds() (map[string]bool, error) {
+	stale := map[string]bool{}
+	if o.recordedColumn == "" || len(o.deleteKeys) == 0 {
+		return stale, nil
+	}
+	for _, keys := range o.chunkKeysBy(o.deleteKeys, recordedKeySize) {
+		stmt, args := o.recordedStatement(keys)
+		o.logger.Debug(stmt)
+		var rows *sql.Rows
+		var err error
+		if o.tx != nil {
+			rows, err = o.tx.QueryContext(o.ctx, stmt, args...)
+		} else {
+			rows, err = o.db.QueryContext(o.ctx, stmt, args...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var id string
+		var recorded sql.NullInt64
+		for rows.Next() {
+			if err := rows.Scan(&id, &recorded); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if recorded.Valid && uint64(recorded.Int64) > o.batchRecorded[id] {
+				stale[id] = true
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(stale) > 0 {
+		o.logger.Debug("skipping entities older than the stored rows", "dataset", o.dataset, "count", len(stale))
+	}
+	return stale, nil
+}
+
+// recordedStatement selects the recorded values of the stored rows of the batch, together with
+// the id of the batch key each row matches. The keys are compared by the database, with the
+// type and collation of the key columns, so a stored "7.00" matches 7 in a DECIMAL column and
+// "ABC" matches "abc" under a case-insensitive collation.
+func (o *MysqlWriter) recordedStatement(keys []rowKey) (string, []any) {
+	var sb strings.Builder
+	args := make([]any, 0, len(keys)*(2*len(o.keyColumns)+1))
+	composite := len(o.keyColumns) > 1
+	sb.WriteString("SELECT CASE")
+	for _, key := range keys {
+		sb.WriteString(" WHEN ")
+		if composite {
+			sb.WriteString("(")
+		}
+		for i, col := range o.keyColumns {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(quoteIdentifier(applyColumnCase(o.columnCase, col)))
+		}
+		if composite {
+			sb.WriteString(") = (")
+		} else {
+			sb.WriteString(" = ")
+		}
+		for i, v := range key.values {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("?")
+			args = append(args, v)
+		}
+		if composite {
+			sb.WriteString(")")
+		}
+		sb.WriteString(" THEN ?")
+		args = append(args, key.id)
+	}
+	sb.WriteString(" END, ")
+	sb.WriteString(quoteIdentifier(applyColumnCase(o.columnCase, o.recordedColumn)))
+	sb.WriteString(" FROM ")
+	sb.WriteString(o.table)
+	sb.WriteString(" WHERE ")
+	match, matchArgs := o.keyMatch(keys)
+	sb.WriteString(match)
+	sb.WriteString(" FOR UPDATE")
+	return sb.String(), append(args, matchArgs...)
+}
+
+// recordedKeySize estimates the bytes a key adds to the recorded statement, which holds the key
+// values twice and the batch id once.
+func recordedKeySize(key rowKey) int {
+	return 2*keySize(key) + argSize(key.id) + len(" WHEN  =  THEN ")
+}
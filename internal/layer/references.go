@@ -0,0 +1,155 @@
+package layer
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+// withForeignKeyReferences returns a copy of the dataset definition whose outgoing mapping also
+// maps each foreign key column of the table to a reference, for foreign_key_references, and
+// the properties replaced by these references.
+func (d *Dataset) withForeignKeyReferences(ctx context.Context) (*cdl.DatasetDefinition, []string, error) {
+	schema, table := resolveTable(d.db.conf.Schema, getConfigProperty(d.datasetDefinition.SourceConfig, TableName))
+	keys, currentSchema, err := tableForeignKeys(ctx, d.db.db, schema, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	mappings := referenceMappings(d.logger, keys, currentSchema, d.db.conf.Schema, d.datasetDefinition, d.definitions())
+	definition, replaced := withReferenceMappings(d.datasetDefinition, mappings)
+	return definition, replaced, nil
+}
+
+// withReferenceMappings returns a copy of the dataset definition with the reference mappings
+// added to its outgoing mapping. With map_all, it also returns the properties map_all emits for
+// the columns of the references, which are dropped from the entities so the columns only come
+// out as references.
+func withReferenceMappings(dsd *cdl.DatasetDefinition, mappings []*cdl.ItemToEntityPropertyMapping) (*cdl.DatasetDefinition, []string) {
+	if len(mappings) == 0 {
+		return dsd, nil
+	}
+	definition := *dsd
+	outgoing := *definition.OutgoingMappingConfig
+	var replaced []string
+	for _, pm := range mappings {
+		pm.Property = applyColumnCase(columnCase(dsd), pm.Property)
+		if outgoing.MapAll {
+			replaced = append(replaced, outgoing.BaseURI+pm.Property)
+		}
+	}
+	outgoing.PropertyMappings = append(append([]*cdl.ItemToEntityPropertyMapping(nil), outgoing.PropertyMappings...), mappings...)
+	definition.OutgoingMappingConfig = &outgoing
+	return &definition, replaced
+}
+
+// definitions returns the definitions of all datasets of the layer, sorted by name.
+func (d *Dataset) definitions() []*cdl.DatasetDefinition {
+	if d.layer == nil {
+		return []*cdl.DatasetDefinition{d.datasetDefinition}
+	}
+	d.layer.mu.RLock()
+	datasets := d.layer.datasets
+	d.layer.mu.RUnlock()
+	definitions := make([]*cdl.DatasetDefinition, 0, len(datasets))
+	for _, name := range sortedNames(datasets) {
+		definitions = append(definitions, datasets[name].datasetDefinition)
+	}
+	return definitions
+}
+
+// referenceMappings returns a reference mapping for each foreign key column that is not mapped
+// explicitly and references the key column of one of the given datasets. currentSchema is the
+// schema of the dataset's table, defaultSchema the configured schema.
+func referenceMappings(logger cdl.Logger, keys []foreignKey, currentSchema string, defaultSchema string, dsd *cdl.DatasetDefinition, definitions []*cdl.DatasetDefinition) []*cdl.ItemToEntityPropertyMapping {
+	mapped := map[string]bool{}
+	for _, pm := range dsd.OutgoingMappingConfig.PropertyMappings {
+		mapped[strings.ToLower(pm.Property)] = true
+	}
+	var mappings []*cdl.ItemToEntityPropertyMapping
+	for _, key := range keys {
+		if mapped[strings.ToLower(key.Column)] {
+			continue
+		}
+		pattern := ""
+		for _, other := range definitions {
+			schema, table := resolveTable(defaultSchema, getConfigProperty(other.SourceConfig, TableName))
+			if schema == "" {
+				schema = currentSchema
+			}
+			if strings.EqualFold(schema, key.ReferencedSchema) && strings.EqualFold(table, key.ReferencedTable) {
+				if pattern = referencePattern(other, key.ReferencedColumn); pattern != "" {
+					break
+				}
+			}
+		}
+		if pattern == "" {
+			logger.Debug("foreign key column left out, it does not reference the key of a dataset with a uri pattern or base_uri",
+				"dataset", dsd.DatasetName, "column", key.Column, "referenced_table", key.ReferencedTable, "referenced_column", key.ReferencedColumn)
+			continue
+		}
+		mapped[strings.ToLower(key.Column)] = true
+		mappings = append(mappings, &cdl.ItemToEntityPropertyMapping{
+			Property:        key.Column,
+			EntityProperty:  key.Column,
+			IsReference:     true,
+			URIValuePattern: pattern,
+		})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Property < mappings[j].Property })
+	return mappings
+}
+
+// referencePattern returns the pattern of references to a dataset's entities through column.
+// The identity's uri_value_pattern is used if column is the identity column. Otherwise column
+// must be the key column of the dataset's table, and the pattern is the dataset's outgoing
+// base_uri, or else its incoming base_uri, followed by the value. Other columns do not identify
+// the entities of the dataset.
+func referencePattern(dsd *cdl.DatasetDefinition, column string) string {
+	outgoing, incoming := dsd.OutgoingMappingConfig, dsd.IncomingMappingConfig
+	if outgoing != nil {
+		for _, pm := range outgoing.PropertyMappings {
+			if pm.IsIdentity && pm.URIValuePattern != "" && strings.EqualFold(pm.Property, column) {
+				return pm.URIValuePattern
+			}
+		}
+	}
+	if !strings.EqualFold(referencedKeyColumn(dsd), column) {
+		return ""
+	}
+	if outgoing != nil && outgoing.BaseURI != "" {
+		return baseURI(outgoing.BaseURI) + "{value}"
+	}
+	if incoming != nil && incoming.BaseURI != "" {
+		return baseURI(incoming.BaseURI) + "{value}"
+	}
+	return ""
+}
+
+// referencedKeyColumn returns the single key column of a dataset's table: a key_columns entry,
+// or the identity column of the outgoing mapping, or else of the incoming mapping, defaulting
+// to id. It returns "" for composite keys.
+func referencedKeyColumn(dsd *cdl.DatasetDefinition) string {
+	_, hasKeyColumns := dsd.SourceConfig[KeyColumns]
+	if !hasKeyColumns && dsd.OutgoingMappingConfig != nil {
+		for _, pm := range dsd.OutgoingMappingConfig.PropertyMappings {
+			if pm.IsIdentity {
+				return pm.Property
+			}
+		}
+	}
+	_, _, keyColumns, err := keyConfig(dsd)
+	if err != nil || len(keyColumns) != 1 {
+		return ""
+	}
+	return keyColumns[0]
+}
+
+// baseURI ensures a base uri ends with a separator, like the mapper does.
+func baseURI(uri string) string {
+	if strings.HasSuffix(uri, "/") || strings.HasSuffix(uri, "#") {
+		return uri
+	}
+	return uri + "/"
+}
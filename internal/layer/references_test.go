@@ -0,0 +1,147 @@
+package layer
+
+import (
+	"database/sql"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestForeignKeyReferences(t *testing.T) {
+	orders := &common.DatasetDefinition{
+		DatasetName:  "orders",
+		SourceConfig: map[string]any{TableName: "order", ForeignKeyRefs: true},
+		OutgoingMappingConfig: &common.OutgoingMappingConfig{
+			BaseURI: "http://data.test/orders/",
+			PropertyMappings: []*common.ItemToEntityPropertyMapping{
+				{Property: "id", IsIdentity: true, URIValuePattern: "http://data.test/orders/{value}"},
+				{Property: "seller_id", EntityProperty: "seller"},
+			},
+		},
+	}
+	customers := &common.DatasetDefinition{
+		DatasetName:  "customers",
+		SourceConfig: map[string]any{TableName: "customer"},
+		OutgoingMappingConfig: &common.OutgoingMappingConfig{
+			BaseURI: "http://data.test/customers",
+			PropertyMappings: []*common.ItemToEntityPropertyMapping{
+				{Property: "id", IsIdentity: true, URIValuePattern: "http://data.test/customer/{value}"},
+			},
+		},
+	}
+	regions := &common.DatasetDefinition{
+		DatasetName:           "regions",
+		SourceConfig:          map[string]any{TableName: "crm.region"},
+		IncomingMappingConfig: &common.IncomingMappingConfig{BaseURI: "http://data.test/regions/"},
+	}
+	warehouses := &common.DatasetDefinition{
+		DatasetName:           "warehouses",
+		SourceConfig:          map[string]any{TableName: "warehouse"},
+		OutgoingMappingConfig: &common.OutgoingMappingConfig{BaseURI: "http://data.test/warehouses"},
+	}
+	suppliers := &common.DatasetDefinition{
+		DatasetName:  "suppliers",
+		SourceConfig: map[string]any{TableName: "supplier"},
+		IncomingMappingConfig: &common.IncomingMappingConfig{
+			BaseURI:          "http://data.test/suppliers/",
+			PropertyMappings: []*common.EntityToItemPropertyMapping{{Property: "number", IsIdentity: true}},
+		},
+	}
+	keys := []foreignKey{
+		{Column: "customer_id", ReferencedSchema: "shop", ReferencedTable: "customer", ReferencedColumn: "id"},
+		{Column: "customer_no", ReferencedSchema: "shop", ReferencedTable: "customer", ReferencedColumn: "number"},
+		{Column: "region_code", ReferencedSchema: "crm", ReferencedTable: "region", ReferencedColumn: "code"},
+		{Column: "seller_id", ReferencedSchema: "shop", ReferencedTable: "customer", ReferencedColumn: "id"},
+		{Column: "supplier_no", ReferencedSchema: "shop", ReferencedTable: "supplier", ReferencedColumn: "number"},
+		{Column: "warehouse_id", ReferencedSchema: "shop", ReferencedTable: "warehouse", ReferencedColumn: "id"},
+	}
+
+	logger := common.NewLogger("test", "text", "error")
+	mappings := referenceMappings(logger, keys, "shop", "", orders, []*common.DatasetDefinition{customers, orders, regions, suppliers, warehouses})
+
+	t.Run("Should only reference the key columns of datasets", func(t *testing.T) {
+		expected := map[string]string{
+			"customer_id":  "http://data.test/customer/{value}",
+			"supplier_no":  "http://data.test/suppliers/{value}",
+			"warehouse_id": "http://data.test/warehouses/{value}",
+		}
+		if len(mappings) != len(expected) {
+			t.Fatalf("Expected %d mappings, got %d", len(expected), len(mappings))
+		}
+		for _, pm := range mappings {
+			if !pm.IsReference || pm.URIValuePattern != expected[pm.Property] {
+				t.Errorf("Unexpected mapping %+v", pm)
+			}
+		}
+	})
+
+	t.Run("Should add the references to outgoing entities", func(t *testing.T) {
+		outgoing := *orders.OutgoingMappingConfig
+		outgoing.PropertyMappings = append(outgoing.PropertyMappings, mappings...)
+		mapper := common.NewMapper(logger, nil, &outgoing)
+		item := &RowItem{Map: map[string]any{
+			"id":          &sql.NullString{String: "1", Valid: true},
+			"customer_id": &sql.NullInt64{Int64: 7, Valid: true},
+		}}
+		entity := egdm.NewEntity()
+		if err := mapper.MapItemToEntity(item, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.References["http://data.test/orders/customer_id"] != "http://data.test/customer/7" {
+			t.Fatalf("Unexpected references %v", entity.References)
+		}
+	})
+
+	t.Run("Should build references from the base_uri of a dataset without a uri_value_pattern", func(t *testing.T) {
+		outgoing := *orders.OutgoingMappingConfig
+		outgoing.PropertyMappings = append(outgoing.PropertyMappings, mappings...)
+		mapper := common.NewMapper(logger, nil, &outgoing)
+		item := &RowItem{Map: map[string]any{
+			"id":           &sql.NullString{String: "1", Valid: true},
+			"warehouse_id": &sql.NullInt64{Int64: 3, Valid: true},
+			"supplier_no":  &sql.NullString{String: "S-9", Valid: true},
+		}}
+		entity := egdm.NewEntity()
+		if err := mapper.MapItemToEntity(item, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.References["http://data.test/orders/warehouse_id"] != "http://data.test/warehouses/3" {
+			t.Fatalf("Unexpected references %v", entity.References)
+		}
+		if entity.References["http://data.test/orders/supplier_no"] != "http://data.test/suppliers/S-9" {
+			t.Fatalf("Unexpected references %v", entity.References)
+		}
+	})
+
+	t.Run("Should drop the map_all property of a referenced column", func(t *testing.T) {
+		all := *orders
+		all.OutgoingMappingConfig = &common.OutgoingMappingConfig{
+			BaseURI:          "http://data.test/orders/",
+			MapAll:           true,
+			PropertyMappings: []*common.ItemToEntityPropertyMapping{{Property: "id", IsIdentity: true, URIValuePattern: "http://data.test/orders/{value}"}},
+		}
+		definition, replaced := withReferenceMappings(&all, referenceMappings(logger, keys, "shop", "", &all, []*common.DatasetDefinition{customers}))
+		mapper := common.NewMapper(logger, nil, definition.OutgoingMappingConfig)
+		item := &RowItem{
+			Columns: []string{"id", "customer_id"},
+			Map: map[string]any{
+				"id":          &sql.NullString{String: "1", Valid: true},
+				"customer_id": &sql.NullInt64{Int64: 7, Valid: true},
+			},
+		}
+		entity := egdm.NewEntity()
+		if err := mapper.MapItemToEntity(item, entity); err != nil {
+			t.Fatal(err)
+		}
+		for _, property := range replaced {
+			delete(entity.Properties, property)
+		}
+		if _, found := entity.Properties["http://data.test/orders/customer_id"]; found {
+			t.Fatalf("Expected the column only as a reference, got %v", entity.Properties)
+		}
+		if entity.References["http://data.test/orders/customer_id"] != "http://data.test/customer/7" {
+			t.Fatalf("Unexpected references %v", entity.References)
+		}
+	})
+}
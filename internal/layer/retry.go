@@ -0,0 +1,74 @@
+package layer
+
+import (
+	"fmt"
+	"time"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+const (
+	// mysql errors that are resolved by running the transaction again
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 200 * time.Millisecond
+)
+
+type retryConfig struct {
+	attempts int
+	backoff  time.Duration
+}
+
+func newRetryConfig(dsd *cdl.DatasetDefinition) retryConfig {
+	rc := retryConfig{attempts: defaultRetryAttempts, backoff: defaultRetryBackoff}
+	if attempts, ok := dsd.SourceConfig[RetryAttempts].(float64); ok {
+		rc.attempts = int(attempts)
+	}
+	if backoff, err := time.ParseDuration(getConfigProperty(dsd.SourceConfig, RetryBackoff)); err == nil {
+		rc.backoff = backoff
+	}
+	return rc
+}
+
+// isRetryable reports whether err is a deadlock or lock wait timeout.
+func isRetryable(err error) bool {
+	n := mysqlErrorNumber(err)
+	return n == errDeadlock || n == errLockWaitTimeout
+}
+
+// restart rolls back the current transaction after a retryable error, waits for the backoff
+// of the given attempt, and replays the statements of the transaction in a new one.
+func (o *MysqlWriter) restart(attempt int, cause error) error {
+	o.logger.Warn("retrying batch after lock conflict", "dataset", o.dataset, "attempt", attempt, "error", cause)
+	if o.metrics != nil {
+		tag := fmt.Sprintf("error:%d", mysqlErrorNumber(cause))
+		if err := o.metrics.Incr("mysql.write.retry", []string{"dataset:" + o.dataset, tag}, 1); err != nil {
+			o.logger.Warn("failed to record metric", "error", err)
+		}
+	}
+
+	if o.tx != nil {
+		// mysql may already have rolled back the transaction, so errors are expected here
+		_ = o.tx.Rollback()
+		o.tx = nil
+		o.shareTx()
+	}
+
+	backoff := o.retry.backoff << (attempt - 1)
+	select {
+	case <-o.ctx.Done():
+		return fmt.Errorf("write cancelled while waiting to retry: %w", cause)
+	case <-time.After(backoff):
+	}
+
+	if o.transactionScope == TransactionScopeNone {
+		return nil
+	}
+	err := o.begin()
+	if err != nil {
+		return err
+	}
+	return o.execAll(o.journal)
+}
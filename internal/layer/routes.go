@@ -0,0 +1,192 @@
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+const rdfType = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+
+// routeDefinition sends the entities of a dataset matching a type reference, or a property
+// predicate with an optional value, to another table with its own incoming mapping.
+type routeDefinition struct {
+	typeRef   string
+	predicate string
+	value     string
+	hasValue  bool
+	// the dataset definition of the route's table, with the source_config of the dataset
+	// overridden by the route's own keys
+	definition *cdl.DatasetDefinition
+}
+
+// routeDefinitions parses the routes in the source_config of a dataset.
+func routeDefinitions(dsd *cdl.DatasetDefinition) ([]routeDefinition, error) {
+	value, found := dsd.SourceConfig[Routes]
+	if !found {
+		return nil, nil
+	}
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of routes", Routes)
+	}
+	routes := make([]routeDefinition, 0, len(list))
+	for i, v := range list {
+		config, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("route %d must be an object", i)
+		}
+		route := routeDefinition{}
+		sourceConfig := make(map[string]any, len(dsd.SourceConfig)+len(config))
+		for key, value := range dsd.SourceConfig {
+			if key != Routes && key != TableName {
+				sourceConfig[key] = value
+			}
+		}
+		for key, value := range config {
+			switch key {
+			case "type":
+				route.typeRef, _ = value.(string)
+			case "property":
+				route.predicate, _ = value.(string)
+			case "value":
+				route.value, route.hasValue = fmt.Sprint(value), value != nil
+			case "incoming_mapping_config":
+			default:
+				sourceConfig[key] = value
+			}
+		}
+		if (route.typeRef == "") == (route.predicate == "") {
+			return nil, fmt.Errorf("route %d needs either a type or a property", i)
+		}
+		if route.typeRef != "" && route.hasValue {
+			return nil, fmt.Errorf("route %d: value can only be used with a property", i)
+		}
+		if getConfigProperty(sourceConfig, TableName) == "" {
+			return nil, fmt.Errorf("route %d needs a %s", i, TableName)
+		}
+		data, err := json.Marshal(config["incoming_mapping_config"])
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+		var mapping *cdl.IncomingMappingConfig
+		if err := json.Unmarshal(data, &mapping); err != nil {
+			return nil, fmt.Errorf("route %d: invalid incoming_mapping_config: %w", i, err)
+		}
+		if mapping == nil {
+			return nil, fmt.Errorf("route %d needs an incoming_mapping_config", i)
+		}
+		route.definition = &cdl.DatasetDefinition{
+			DatasetName:           dsd.DatasetName,
+			SourceConfig:          sourceConfig,
+			IncomingMappingConfig: mapping,
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// routeDatasets returns a dataset for the table of each route, sharing the connection pool of
+// the dataset.
+func (d *Dataset) routeDatasets() ([]*Dataset, []routeDefinition, error) {
+	routes, err := routeDefinitions(d.datasetDefinition)
+	if err != nil {
+		return nil, nil, err
+	}
+	datasets := make([]*Dataset, len(routes))
+	for i, route := range routes {
+		datasets[i] = &Dataset{
+			logger:            d.logger,
+			metrics:           d.metrics,
+			db:                d.db,
+			datasetDefinition: route.definition,
+			layer:             d.layer,
+		}
+	}
+	return datasets, routes, nil
+}
+
+// matches reports whether an entity is sent to the route's table.
+func (r routeDefinition) matches(entity *egdm.Entity) bool {
+	if r.typeRef != "" {
+		return hasValue(entity.References[rdfType], r.typeRef)
+	}
+	v, found := entity.Properties[r.predicate]
+	if !found {
+		v, found = entity.References[r.predicate]
+	}
+	if !found || v == nil {
+		return false
+	}
+	return !r.hasValue || hasValue(v, r.value)
+}
+
+// hasValue reports whether a property value, or any item of a list value, equals want.
+func hasValue(v any, want string) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case []any:
+		for _, item := range v {
+			if hasValue(item, want) {
+				return true
+			}
+		}
+		return false
+	case []string:
+		for _, item := range v {
+			if item == want {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(v) == want
+	}
+}
+
+// route is a routeDefinition with the writer of its table.
+type route struct {
+	routeDefinition
+	writer *MysqlWriter
+}
+
+// targets returns the writers an entity is written to: the first matching route, or else the
+// dataset's own table. Deleted entities matching no route are removed from every table, since
+// they often come without the properties they were routed by.
+func (o *MysqlWriter) targets(entity *egdm.Entity) []*MysqlWriter {
+	for _, r := range o.routes {
+		if r.matches(entity) {
+			return []*MysqlWriter{r.writer}
+		}
+	}
+	if entity.IsDeleted {
+		return o.writers()
+	}
+	if o.table != "" {
+		return []*MysqlWriter{o}
+	}
+	return nil
+}
+
+// writers returns the writer of the dataset's own table, if it has one, and those of its routes.
+func (o *MysqlWriter) writers() []*MysqlWriter {
+	writers := make([]*MysqlWriter, 0, len(o.routes)+1)
+	if o.table != "" {
+		writers = append(writers, o)
+	}
+	for _, r := range o.routes {
+		writers = append(writers, r.writer)
+	}
+	return writers
+}
+
+// shareTx hands the writer's transaction to the writers of its routes, so a request is
+// committed or rolled back as a whole.
+func (o *MysqlWriter) shareTx() {
+	for _, r := range o.routes {
+		r.writer.tx = o.tx
+	}
+}
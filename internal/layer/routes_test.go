@@ -0,0 +1,191 @@
+package layer
+
+import (
+	"strings"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func testRoutes() []any {
+	return []any{
+		map[string]any{
+			"type":        "http://data.test/Person",
+			"table_name":  "person",
+			"key_columns": []any{"person_id"},
+			"incoming_mapping_config": map[string]any{
+				"base_uri": "http://data.test/",
+				"property_mappings": []any{
+					map[string]any{"property": "person_id", "is_identity": true, "strip_ref_prefix": true},
+				},
+			},
+		},
+		map[string]any{
+			"property":   "http://data.test/kind",
+			"value":      "company",
+			"table_name": "company",
+			"incoming_mapping_config": map[string]any{
+				"base_uri":          "http://data.test/",
+				"property_mappings": []any{map[string]any{"property": "id", "is_identity": true, "strip_ref_prefix": true}},
+			},
+		},
+	}
+}
+
+func TestRouteDefinitions(t *testing.T) {
+	t.Run("Should override the source config of the dataset", func(t *testing.T) {
+		routes, err := routeDefinitions(&common.DatasetDefinition{
+			DatasetName:  "parties",
+			SourceConfig: map[string]any{TableName: "party", SinceColumn: "updated", Routes: testRoutes()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(routes) != 2 || routes[0].typeRef != "http://data.test/Person" || routes[1].predicate != "http://data.test/kind" || routes[1].value != "company" {
+			t.Fatalf("Unexpected routes %+v", routes)
+		}
+		sourceConfig := routes[0].definition.SourceConfig
+		if sourceConfig[TableName] != "person" || sourceConfig[SinceColumn] != "updated" || sourceConfig[Routes] != nil {
+			t.Fatalf("Unexpected source config %v", sourceConfig)
+		}
+		if m := routes[0].definition.IncomingMappingConfig; m == nil || len(m.PropertyMappings) != 1 || !m.PropertyMappings[0].IsIdentity {
+			t.Fatalf("Unexpected incoming mapping %+v", m)
+		}
+	})
+
+	t.Run("Should report invalid routes", func(t *testing.T) {
+		definitions := []*common.DatasetDefinition{{
+			DatasetName: "parties",
+			SourceConfig: map[string]any{Routes: []any{
+				map[string]any{"type": "http://data.test/Person", "table_name": "person", "flush_threshold": "many", "incoming_mapping_config": map[string]any{}},
+			}},
+		}}
+		err := validateDatasetDefinitions(definitions)
+		if err == nil || !strings.Contains(err.Error(), "dataset parties: route 0: flush_threshold must be a number") {
+			t.Fatalf("Expected a route error, got %v", err)
+		}
+		for _, route := range []map[string]any{
+			{"table_name": "person", "incoming_mapping_config": map[string]any{}},
+			{"type": "http://data.test/Person", "incoming_mapping_config": map[string]any{}},
+			{"type": "http://data.test/Person", "table_name": "person"},
+		} {
+			_, err := routeDefinitions(&common.DatasetDefinition{SourceConfig: map[string]any{Routes: []any{route}}})
+			if err == nil {
+				t.Errorf("Expected an error for %v", route)
+			}
+		}
+	})
+}
+
+func newRouteTestWriter(t *testing.T, table bool) *MysqlWriter {
+	w := newKeyTestWriter(t, map[string]any{})
+	if !table {
+		w.table = ""
+	}
+	routes, err := routeDefinitions(&common.DatasetDefinition{SourceConfig: map[string]any{Routes: testRoutes()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range routes {
+		rw := newKeyTestWriter(t, r.definition.SourceConfig)
+		rw.mapper = common.NewMapper(rw.logger, r.definition.IncomingMappingConfig, nil)
+		rw.propertyMappings = r.definition.IncomingMappingConfig.PropertyMappings
+		rw.table = quoteTable("", []string{"person", "company"}[i])
+		w.routes = append(w.routes, &route{routeDefinition: r, writer: rw})
+	}
+	return w
+}
+
+func TestRoutes(t *testing.T) {
+	person := egdm.NewEntity().SetID("http://data.test/p1")
+	person.SetReference(rdfType, "http://data.test/Person")
+	company := egdm.NewEntity().SetID("http://data.test/c1")
+	company.SetProperty("http://data.test/kind", "company")
+	other := egdm.NewEntity().SetID("http://data.test/o1")
+	other.SetProperty("http://data.test/kind", "other")
+
+	t.Run("Should write entities to the table of the first matching route", func(t *testing.T) {
+		w := newRouteTestWriter(t, true)
+		for _, entity := range []*egdm.Entity{person, company, other} {
+			if err := w.Write(entity); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, found := w.routes[0].writer.batchInserts["p1"]; !found || len(w.routes[0].writer.batchInserts) != 1 {
+			t.Fatalf("Expected the person in the person table, got %v", w.routes[0].writer.batchInserts)
+		}
+		if _, found := w.routes[1].writer.batchInserts["c1"]; !found || len(w.routes[1].writer.batchInserts) != 1 {
+			t.Fatalf("Expected the company in the company table, got %v", w.routes[1].writer.batchInserts)
+		}
+		if _, found := w.batchInserts["o1"]; !found || len(w.batchInserts) != 1 {
+			t.Fatalf("Expected other entities in the dataset table, got %v", w.batchInserts)
+		}
+		// removals from the tables an entity was not routed to do not count towards the threshold
+		if size, _ := w.pending(); size != 3 {
+			t.Fatalf("Expected 3 pending rows, got %d", size)
+		}
+		statements, err := w.routes[0].writer.batchStatements()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statements[0].stmt != "DELETE FROM `person` WHERE `person_id` IN (?, ?, ?)" || len(statements) != 2 {
+			t.Fatalf("Expected one delete for the entities of the other tables, got %v", statements)
+		}
+	})
+
+	t.Run("Should fail the write when an entity cannot be removed from another table", func(t *testing.T) {
+		w := newRouteTestWriter(t, true)
+		w.routes[0].writer.propertyMappings = []*common.EntityToItemPropertyMapping{{Property: "person_id", Datatype: "int"}}
+		if err := w.Write(company); err == nil || !strings.Contains(err.Error(), "cannot be removed from `person`") {
+			t.Fatalf("Expected the removal to fail, got %v", err)
+		}
+	})
+
+	t.Run("Should remove deleted entities without a route from every table", func(t *testing.T) {
+		w := newRouteTestWriter(t, true)
+		deleted := egdm.NewEntity().SetID("http://data.test/d1")
+		deleted.IsDeleted = true
+		if err := w.Write(deleted); err != nil {
+			t.Fatal(err)
+		}
+		for _, writer := range w.writers() {
+			if len(writer.deleteKeys) != 1 || writer.deleteKeys[0].id != "d1" {
+				t.Fatalf("Expected a delete in %s, got %v", writer.table, writer.deleteKeys)
+			}
+		}
+	})
+
+	t.Run("Should remove an entity from the tables it is no longer routed to", func(t *testing.T) {
+		w := newRouteTestWriter(t, true)
+		before := egdm.NewEntity().SetID("http://data.test/x1")
+		before.SetReference(rdfType, "http://data.test/Person")
+		before.Recorded = 1
+		after := egdm.NewEntity().SetID("http://data.test/x1")
+		after.SetProperty("http://data.test/kind", "company")
+		after.Recorded = 2
+		for _, entity := range []*egdm.Entity{before, after} {
+			if err := w.Write(entity); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, found := w.routes[1].writer.batchInserts["x1"]; !found {
+			t.Fatalf("Expected the entity in the company table, got %v", w.routes[1].writer.batchInserts)
+		}
+		for _, writer := range []*MysqlWriter{w, w.routes[0].writer} {
+			if len(writer.batchInserts) != 0 || len(writer.deleteKeys) != 1 || writer.deleteKeys[0].id != "x1" {
+				t.Fatalf("Expected the entity to be removed from %s, got %v %v", writer.table, writer.batchInserts, writer.deleteKeys)
+			}
+		}
+	})
+
+	t.Run("Should reject entities without a route when the dataset has no table", func(t *testing.T) {
+		w := newRouteTestWriter(t, false)
+		if err := w.Write(person); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(other); err == nil {
+			t.Fatalf("Expected an error for an entity without a route")
+		}
+	})
+}
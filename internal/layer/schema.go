@@ -0,0 +1,172 @@
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// columnInfo describes a table column as reported by information_schema.COLUMNS
+type columnInfo struct {
+	Name       string `json:"name"`
+	DataType   string `json:"data_type"`
+	ColumnType string `json:"column_type"`
+	Nullable   bool   `json:"nullable"`
+	PrimaryKey bool   `json:"primary_key"`
+}
+
+// tableColumns returns the columns of a table in ordinal order. An empty result means the
+// table does not exist. If schema is empty, the current database is used.
+func tableColumns(ctx context.Context, db *sql.DB, schema string, table string) ([]columnInfo, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE, COLUMN_KEY FROM information_schema.COLUMNS "+
+			"WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION",
+		schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []columnInfo
+	for rows.Next() {
+		var c columnInfo
+		var nullable, key string
+		err = rows.Scan(&c.Name, &c.DataType, &c.ColumnType, &nullable, &key)
+		if err != nil {
+			return nil, err
+		}
+		c.Nullable = nullable == "YES"
+		c.PrimaryKey = key == "PRI"
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// foreignKey is a column of a single-column foreign key, as reported by
+// information_schema.KEY_COLUMN_USAGE
+type foreignKey struct {
+	Column           string
+	ReferencedSchema string
+	ReferencedTable  string
+	ReferencedColumn string
+}
+
+// tableForeignKeys returns the single-column foreign keys of a table. Composite foreign keys
+// are left out, since a reference holds one value. If schema is empty, the current database is
+// used. currentSchema is the schema the table was found in.
+func tableForeignKeys(ctx context.Context, db *sql.DB, schema string, table string) ([]foreignKey, string, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT CONSTRAINT_NAME, TABLE_SCHEMA, COLUMN_NAME, REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME "+
+			"FROM information_schema.KEY_COLUMN_USAGE "+
+			"WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND TABLE_NAME = ? AND REFERENCED_TABLE_NAME IS NOT NULL "+
+			"ORDER BY CONSTRAINT_NAME, ORDINAL_POSITION",
+		schema, table)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var keys []foreignKey
+	var constraints []string
+	columns := map[string]int{}
+	currentSchema := ""
+	for rows.Next() {
+		var constraint string
+		var k foreignKey
+		err = rows.Scan(&constraint, &currentSchema, &k.Column, &k.ReferencedSchema, &k.ReferencedTable, &k.ReferencedColumn)
+		if err != nil {
+			return nil, "", err
+		}
+		columns[constraint]++
+		constraints = append(constraints, constraint)
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	single := make([]foreignKey, 0, len(keys))
+	for i, k := range keys {
+		if columns[constraints[i]] == 1 {
+			single = append(single, k)
+		}
+	}
+	return single, currentSchema, nil
+}
+
+// tableColumns returns the columns of a configured table name, resolving its schema against the
+// configured default schema.
+func (d *Dataset) tableColumns(ctx context.Context, tableName string) ([]columnInfo, error) {
+	schema, table := resolveTable(d.db.conf.Schema, tableName)
+	return tableColumns(ctx, d.db.db, schema, table)
+}
+
+// findColumn looks up a column by name. MySQL column names are case-insensitive.
+func findColumn(columns []columnInfo, name string) (columnInfo, bool) {
+	for _, c := range columns {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return columnInfo{}, false
+}
+
+// quoteIdentifier backtick-quotes a single table or column name, doubling embedded backticks.
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// splitTableName splits a table name into schema and table. The name may be qualified as
+// schema.table, and either part may be backtick-quoted to contain dots. The schema is empty
+// for unqualified names.
+func splitTableName(name string) (schema string, table string) {
+	var parts []string
+	var current strings.Builder
+	quoted := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '`' && quoted && i+1 < len(name) && name[i+1] == '`':
+			current.WriteByte('`')
+			i++
+		case c == '`':
+			quoted = !quoted
+		case c == '.' && !quoted && len(parts) == 0:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	parts = append(parts, current.String())
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// resolveTable returns the schema and table for a configured table name, using defaultSchema
+// when the name does not carry a schema of its own.
+func resolveTable(defaultSchema string, name string) (schema string, table string) {
+	schema, table = splitTableName(name)
+	if schema == "" {
+		schema = defaultSchema
+	}
+	return schema, table
+}
+
+// quoteTable returns the quoted, schema-qualified form of a configured table name.
+func quoteTable(defaultSchema string, name string) string {
+	schema, table := resolveTable(defaultSchema, name)
+	if schema == "" {
+		return quoteIdentifier(table)
+	}
+	return quoteIdentifier(schema) + "." + quoteIdentifier(table)
+}
+
+// quoteColumn returns a quoted column reference qualified with the table part of a configured
+// table name. The schema is left out so the reference also matches an unqualified table in a
+// custom data_query.
+func quoteColumn(tableName string, column string) string {
+	_, table := splitTableName(tableName)
+	return quoteIdentifier(table) + "." + quoteIdentifier(column)
+}
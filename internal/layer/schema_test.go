@@ -0,0 +1,41 @@
+package layer
+
+import (
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestQuoteTable(t *testing.T) {
+	cases := []struct {
+		schema, name, expected string
+	}{
+		{"", "order", "`order`"},
+		{"sales", "order", "`sales`.`order`"},
+		{"sales", "crm.Customer-Data", "`crm`.`Customer-Data`"},
+		{"", "`my.table`", "`my.table`"},
+		{"", "`we``ird`", "`we``ird`"},
+	}
+	for _, c := range cases {
+		if actual := quoteTable(c.schema, c.name); actual != c.expected {
+			t.Errorf("quoteTable(%q, %q) = %s, expected %s", c.schema, c.name, actual, c.expected)
+		}
+	}
+}
+
+func TestBuildQueryQuotesIdentifiers(t *testing.T) {
+	definition := &common.DatasetDefinition{
+		SourceConfig: map[string]any{TableName: "order", SinceColumn: "Group"},
+		OutgoingMappingConfig: &common.OutgoingMappingConfig{
+			PropertyMappings: []*common.ItemToEntityPropertyMapping{{Property: "id"}, {Property: "group"}},
+		},
+	}
+	q, err := buildQuery(definition, "sales", "", "2024-01-01 00:00:00.000000", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT `id`, `group` FROM `sales`.`order` WHERE `order`.`Group` <= '2024-01-01 00:00:00.000000' LIMIT 10"
+	if q != expected {
+		t.Fatalf("Unexpected query:\n%s\nexpected:\n%s", q, expected)
+	}
+}
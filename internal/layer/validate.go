@@ -0,0 +1,313 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	cdl "github.com/mimiro-io/common-datalayer"
+)
+
+// outgoingDatatypes lists the datatypes the common-datalayer outgoing mapper can convert read
+// values to. Any other datatype fails every read of the dataset.
+var outgoingDatatypes = map[string]bool{
+	"": true, "string": true, "bool": true,
+	"int": true, "integer": true, "long": true, "float": true, "double": true,
+}
+
+type configKind int
+
+const (
+	kindString configKind = iota
+	kindNumber
+	kindBool
+	kindJSON
+)
+
+func (k configKind) String() string {
+	switch k {
+	case kindNumber:
+		return "a number"
+	case kindBool:
+		return "true or false"
+	case kindJSON:
+		return "a list or an object"
+	default:
+		return "a string"
+	}
+}
+
+// configOption declares the type of a source_config key, and optionally further constraints
+// on its value.
+type configOption struct {
+	kind  configKind
+	check func(value any) error
+}
+
+// sourceConfigOptions lists every source_config key the layer understands.
+var sourceConfigOptions = map[string]configOption{
+	TableName:        {kind: kindString, check: notEmpty},
+	FlushThreshold:   {kind: kindNumber, check: positiveInteger},
+	FlushBytes:       {kind: kindNumber, check: positiveInteger},
+	AppendMode:       {kind: kindBool},
+	SinceColumn:      {kind: kindString, check: notEmpty},
+	SincePrecision:   {kind: kindString, check: oneOf("0", "1", "2", "3", "4", "5", "6")},
+	EntityColumn:     {kind: kindString, check: notEmpty},
+	SinceTable:       {kind: kindString, check: notEmpty},
+	DataQuery:        {kind: kindString, check: notEmpty},
+	AutoCreateTable:  {kind: kindBool},
+	AutoMigrate:      {kind: kindBool},
+	SchemaCheck:      {kind: kindString, check: oneOf(SchemaCheckOff, SchemaCheckWarn, SchemaCheckFail)},
+	ColumnCase:       {kind: kindString, check: oneOf(ColumnCasePreserve, ColumnCaseLower)},
+	TransactionScope: {kind: kindString, check: oneOf(TransactionScopeRequest, TransactionScopeFlush, TransactionScopeNone)},
+	RetryAttempts:    {kind: kindNumber, check: nonNegativeInteger},
+	RetryBackoff:     {kind: kindString, check: duration},
+	DeadLetterTable:  {kind: kindString, check: notEmpty},
+	RecordedColumn:   {kind: kindString, check: notEmpty},
+	KeyColumns:       {kind: kindJSON, check: stringList},
+	IdentityPattern:  {kind: kindString, check: namedGroups},
+	Routes:           {kind: kindJSON},
+	Joins:            {kind: kindJSON},
+	ForeignKeyRefs:   {kind: kindBool},
+}
+
+// validateDatasetDefinitions checks every dataset definition against sourceConfigOptions and
+// returns all problems found, or nil.
+func validateDatasetDefinitions(definitions []*cdl.DatasetDefinition) cdl.LayerError {
+	var errs []error
+	names := map[string]bool{}
+	for _, dsd := range definitions {
+		if dsd.DatasetName == "" {
+			errs = append(errs, fmt.Errorf("dataset definition without name"))
+			continue
+		}
+		if names[dsd.DatasetName] {
+			errs = append(errs, fmt.Errorf("dataset %s: defined more than once", dsd.DatasetName))
+		}
+		names[dsd.DatasetName] = true
+		for _, err := range validateDatasetDefinition(dsd) {
+			errs = append(errs, fmt.Errorf("dataset %s: %w", dsd.DatasetName, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return cdl.Err(fmt.Errorf("invalid dataset configuration: %w", errors.Join(errs...)), cdl.LayerErrorBadParameter)
+}
+
+func validateDatasetDefinition(dsd *cdl.DatasetDefinition) []error {
+	var errs []error
+	sourceConfig := dsd.SourceConfig
+
+	// sort keys so problems are always reported in the same order
+	keys := make([]string, 0, len(sourceConfig))
+	for key := range sourceConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := sourceConfig[key]
+		option, known := sourceConfigOptions[key]
+		if !known {
+			errs = append(errs, fmt.Errorf("unknown source_config key %s", key))
+			continue
+		}
+		if !hasKind(value, option.kind) {
+			errs = append(errs, fmt.Errorf("%s must be %s, got %v", key, option.kind, value))
+			continue
+		}
+		if option.check != nil {
+			if err := option.check(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s %w", key, err))
+			}
+		}
+	}
+
+	_, hasRoutes := sourceConfig[Routes]
+	if hasRoutes {
+		routes, err := routeDefinitions(dsd)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for i, route := range routes {
+			for _, err := range validateDatasetDefinition(route.definition) {
+				errs = append(errs, fmt.Errorf("route %d: %w", i, err))
+			}
+		}
+	}
+
+	if _, found := sourceConfig[Joins]; found {
+		if _, err := joinDefinitions(dsd, ""); err != nil {
+			errs = append(errs, err)
+		}
+		if _, found := sourceConfig[DataQuery]; found {
+			errs = append(errs, fmt.Errorf("%s cannot be combined with a %s", Joins, DataQuery))
+		}
+	}
+
+	if _, found := sourceConfig[TableName]; !found {
+		if dsd.IncomingMappingConfig != nil {
+			errs = append(errs, fmt.Errorf("%s is required to write to the dataset", TableName))
+		} else if _, found := sourceConfig[DataQuery]; !found && !hasRoutes {
+			errs = append(errs, fmt.Errorf("%s or %s is required", TableName, DataQuery))
+		}
+	}
+	if _, found := sourceConfig[SinceColumn]; found {
+		_, hasTable := sourceConfig[TableName]
+		_, hasSinceTable := sourceConfig[SinceTable]
+		if !hasTable && !hasSinceTable {
+			errs = append(errs, fmt.Errorf("%s needs %s or %s", SinceColumn, SinceTable, TableName))
+		}
+	}
+	if dsd.IncomingMappingConfig != nil {
+		for _, pm := range dsd.IncomingMappingConfig.PropertyMappings {
+			if !datatypes[pm.Datatype] {
+				errs = append(errs, fmt.Errorf("property %s has unknown datatype %s", pm.Property, pm.Datatype))
+			}
+		}
+	}
+	if dsd.OutgoingMappingConfig != nil {
+		for _, pm := range dsd.OutgoingMappingConfig.PropertyMappings {
+			if !outgoingDatatypes[pm.Datatype] {
+				errs = append(errs, fmt.Errorf("outgoing property %s has unsupported datatype %s", pm.Property, pm.Datatype))
+			}
+		}
+	}
+	if (sourceConfig[AutoCreateTable] == true || sourceConfig[AutoMigrate] == true) && dsd.IncomingMappingConfig == nil && !hasRoutes {
+		errs = append(errs, fmt.Errorf("%s and %s need an incoming_mapping_config", AutoCreateTable, AutoMigrate))
+	}
+	if sourceConfig[ForeignKeyRefs] == true {
+		if dsd.OutgoingMappingConfig == nil || dsd.OutgoingMappingConfig.BaseURI == "" {
+			errs = append(errs, fmt.Errorf("%s needs an outgoing_mapping_config with a base_uri", ForeignKeyRefs))
+		}
+		if _, found := sourceConfig[TableName]; !found {
+			errs = append(errs, fmt.Errorf("%s needs a %s", ForeignKeyRefs, TableName))
+		}
+	}
+	if getConfigProperty(sourceConfig, RecordedColumn) != "" {
+		if transactionScope(dsd) == TransactionScopeNone {
+			errs = append(errs, fmt.Errorf("%s cannot be combined with %s %s", RecordedColumn, TransactionScope, TransactionScopeNone))
+		}
+		// deleted entities are kept as rows, so readers must be able to tell them apart
+		if dsd.IncomingMappingConfig != nil && !hasDeletedMapping(dsd.IncomingMappingConfig) && getConfigProperty(sourceConfig, EntityColumn) == "" {
+			errs = append(errs, fmt.Errorf("%s needs a property mapping with is_deleted or an %s, to keep deleted rows", RecordedColumn, EntityColumn))
+		}
+	}
+	if entityColumn := getConfigProperty(sourceConfig, EntityColumn); entityColumn != "" && dsd.IncomingMappingConfig != nil {
+		for _, pm := range dsd.IncomingMappingConfig.PropertyMappings {
+			if strings.EqualFold(pm.Property, entityColumn) {
+				errs = append(errs, fmt.Errorf("%s %s is also the column of a property mapping", EntityColumn, entityColumn))
+			}
+		}
+	}
+	if dsd.OutgoingMappingConfig == nil && dsd.IncomingMappingConfig == nil && getConfigProperty(sourceConfig, EntityColumn) == "" && !hasRoutes {
+		errs = append(errs, fmt.Errorf("needs an incoming_mapping_config, an outgoing_mapping_config or %s", EntityColumn))
+	}
+
+	return errs
+}
+
+func hasDeletedMapping(mapping *cdl.IncomingMappingConfig) bool {
+	for _, pm := range mapping.PropertyMappings {
+		if pm.IsDeleted {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKind(value any, kind configKind) bool {
+	switch kind {
+	case kindNumber:
+		_, ok := value.(float64)
+		return ok
+	case kindBool:
+		_, ok := value.(bool)
+		return ok
+	case kindJSON:
+		switch value.(type) {
+		case []any, map[string]any:
+			return true
+		}
+		return false
+	default:
+		_, ok := value.(string)
+		return ok
+	}
+}
+
+func notEmpty(value any) error {
+	if value == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func positiveInteger(value any) error {
+	f := value.(float64)
+	if f < 1 || f != math.Trunc(f) {
+		return fmt.Errorf("must be a positive integer, got %v", f)
+	}
+	return nil
+}
+
+func nonNegativeInteger(value any) error {
+	f := value.(float64)
+	if f < 0 || f != math.Trunc(f) {
+		return fmt.Errorf("must be zero or a positive integer, got %v", f)
+	}
+	return nil
+}
+
+func duration(value any) error {
+	d, err := time.ParseDuration(value.(string))
+	if err != nil || d < 0 {
+		return fmt.Errorf("must be a duration such as 200ms or 1s, got %v", value)
+	}
+	return nil
+}
+
+func oneOf(allowed ...string) func(value any) error {
+	return func(value any) error {
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %v, got %v", allowed, value)
+	}
+}
+
+func stringList(value any) error {
+	list, ok := value.([]any)
+	if !ok {
+		return fmt.Errorf("must be a list, got %v", value)
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("must not be empty")
+	}
+	for _, v := range list {
+		if s, ok := v.(string); !ok || s == "" {
+			return fmt.Errorf("must be a list of names, got %v", value)
+		}
+	}
+	return nil
+}
+
+func namedGroups(value any) error {
+	re, err := regexp.Compile(value.(string))
+	if err != nil {
+		return fmt.Errorf("must be a regular expression: %w", err)
+	}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("must have named groups such as (?P<column>...), got %v", value)
+}
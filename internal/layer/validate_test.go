@@ -0,0 +1,120 @@
+package layer
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestValidateDatasetDefinitions(t *testing.T) {
+	t.Run("Should accept the sample layer config", func(t *testing.T) {
+		b, err := os.ReadFile("../../resources/layer/config.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &common.Config{}
+		if err = json.Unmarshal(b, config); err != nil {
+			t.Fatal(err)
+		}
+		if lerr := validateDatasetDefinitions(config.DatasetDefinitions); lerr != nil {
+			t.Fatal(lerr)
+		}
+	})
+
+	t.Run("Should report all problems with the dataset name", func(t *testing.T) {
+		definitions := []*common.DatasetDefinition{{
+			DatasetName: "products",
+			SourceConfig: map[string]any{
+				FlushThreshold:  "many",
+				SincePrecision:  "9",
+				KeyColumns:      []any{"order", 1.0},
+				IdentityPattern: "^(.*)$",
+				"tabel_name":    "product",
+			},
+			IncomingMappingConfig: &common.IncomingMappingConfig{},
+		}}
+		err := validateDatasetDefinitions(definitions)
+		if err == nil {
+			t.Fatalf("Expected validation to fail")
+		}
+		for _, expected := range []string{
+			"dataset products: flush_threshold must be a number",
+			"dataset products: since_precision must be one of",
+			"dataset products: key_columns must be a list of names",
+			"dataset products: identity_pattern must have named groups",
+			"dataset products: unknown source_config key tabel_name",
+			"dataset products: table_name is required",
+		} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected error to contain %q, got %s", expected, err.Error())
+			}
+		}
+	})
+
+	t.Run("Should reject a recorded_column that cannot keep deleted rows", func(t *testing.T) {
+		definitions := []*common.DatasetDefinition{{
+			DatasetName:           "products",
+			SourceConfig:          map[string]any{TableName: "product", RecordedColumn: "recorded", TransactionScope: TransactionScopeNone},
+			IncomingMappingConfig: &common.IncomingMappingConfig{},
+		}}
+		err := validateDatasetDefinitions(definitions)
+		if err == nil {
+			t.Fatalf("Expected validation to fail")
+		}
+		for _, expected := range []string{
+			"recorded_column cannot be combined with transaction_scope none",
+			"recorded_column needs a property mapping with is_deleted or an entity_column",
+		} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected error to contain %q, got %s", expected, err.Error())
+			}
+		}
+	})
+
+	t.Run("Should reject an entity_column that is also a mapped column", func(t *testing.T) {
+		definitions := []*common.DatasetDefinition{{
+			DatasetName:  "products",
+			SourceConfig: map[string]any{TableName: "product", EntityColumn: "entity"},
+			IncomingMappingConfig: &common.IncomingMappingConfig{
+				PropertyMappings: []*common.EntityToItemPropertyMapping{{Property: "Entity", EntityProperty: "entity"}},
+			},
+		}}
+		err := validateDatasetDefinitions(definitions)
+		if err == nil || !strings.Contains(err.Error(), "entity_column entity is also the column of a property mapping") {
+			t.Fatalf("Expected validation to fail, got %v", err)
+		}
+	})
+
+	t.Run("Should reject outgoing datatypes the outgoing mapper cannot convert to", func(t *testing.T) {
+		definitions := []*common.DatasetDefinition{{
+			DatasetName:  "products",
+			SourceConfig: map[string]any{TableName: "product"},
+			OutgoingMappingConfig: &common.OutgoingMappingConfig{
+				PropertyMappings: []*common.ItemToEntityPropertyMapping{
+					{Property: "id", IsIdentity: true},
+					{Property: "price", Datatype: "double"},
+					{Property: "created", Datatype: "datetime"},
+					{Property: "external_id", Datatype: "uuid"},
+				},
+			},
+		}}
+		err := validateDatasetDefinitions(definitions)
+		if err == nil {
+			t.Fatalf("Expected validation to fail")
+		}
+		for _, expected := range []string{
+			"outgoing property created has unsupported datatype datetime",
+			"outgoing property external_id has unsupported datatype uuid",
+		} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected error to contain %q, got %s", expected, err.Error())
+			}
+		}
+		if strings.Contains(err.Error(), "price") {
+			t.Errorf("Expected double to be accepted, got %s", err.Error())
+		}
+	})
+}
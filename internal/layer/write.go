@@ -3,9 +3,12 @@ package layer
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
-	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
@@ -17,22 +20,72 @@ func (d *Dataset) FullSync(ctx context.Context, batchInfo common.BatchInfo) (com
 }
 
 func (d *Dataset) Incremental(ctx context.Context) (common.DatasetWriter, common.LayerError) {
+	writer, err := d.incremental(ctx)
+	if err != nil && d.layer != nil {
+		// credentials may have been rotated or the host may be gone, retry once on a fresh pool
+		if ds := d.layer.reconnectDataset(d, err); ds != nil {
+			d.logger.Info("retrying write on a new connection pool", "dataset", d.Name(), "error", err)
+			writer, err = ds.incremental(ctx)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (d *Dataset) incremental(ctx context.Context) (*MysqlWriter, common.LayerError) {
 	writer, err := d.newMysqlWriter(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	// hold on to the pool until the writer is closed, so a configuration reload does not close it underneath us
+	if err := d.db.acquire(); err != nil {
+		return nil, common.Err(err, common.LayerErrorInternal)
+	}
+	writer.pool = d.db
+
 	berr := writer.begin()
-	return writer, common.Err(berr, common.LayerErrorInternal)
+	if berr != nil {
+		writer.release()
+		return nil, common.Err(berr, common.LayerErrorInternal)
+	}
+	return writer, nil
 }
 
 func (d *Dataset) newMysqlWriter(ctx context.Context) (*MysqlWriter, common.LayerError) {
+	writer, err := d.tableWriter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	datasets, routes, rerr := d.routeDatasets()
+	if rerr != nil {
+		return nil, common.Err(rerr, common.LayerErrorBadParameter)
+	}
+	for i, ds := range datasets {
+		routeWriter, err := ds.tableWriter(ctx)
+		if err != nil {
+			return nil, err
+		}
+		writer.routes = append(writer.routes, &route{routeDefinition: routes[i], writer: routeWriter})
+	}
+	return writer, nil
+}
+
+// tableWriter creates the writer for the dataset's table. With routes, a dataset does not need
+// a table of its own, and the writer then only routes entities.
+func (d *Dataset) tableWriter(ctx context.Context) (*MysqlWriter, common.LayerError) {
 	mapper := common.NewMapper(d.logger, d.datasetDefinition.IncomingMappingConfig, d.datasetDefinition.OutgoingMappingConfig)
 	db := d.db.db
 	tableName, ok := d.datasetDefinition.SourceConfig[TableName].(string)
-	if !ok {
+	if !ok && d.datasetDefinition.SourceConfig[Routes] == nil {
 		return nil, ErrGeneric("table name not found in source config for dataset %s", d.datasetDefinition.DatasetName)
 	}
+	table := ""
+	if ok && d.datasetDefinition.IncomingMappingConfig != nil {
+		table = quoteTable(d.db.conf.Schema, tableName)
+	}
 	flushThreshold := 1000
 	flushThresholdOverride, ok := d.datasetDefinition.SourceConfig[FlushThreshold]
 	if ok {
@@ -42,285 +95,610 @@ func (d *Dataset) newMysqlWriter(ctx context.Context) (*MysqlWriter, common.Laye
 		}
 		flushThreshold = int(flushThresholdF)
 	}
-	idColumn := "id"
-	for _, m := range d.datasetDefinition.IncomingMappingConfig.PropertyMappings {
-		if m.IsIdentity {
-			idColumn = m.Property
-			break
-		}
+	idColumn, identityPattern, keyColumns, err := keyConfig(d.datasetDefinition)
+	if err != nil {
+		return nil, common.Err(err, common.LayerErrorBadParameter)
+	}
+	var propertyMappings []*common.EntityToItemPropertyMapping
+	if d.datasetDefinition.IncomingMappingConfig != nil {
+		propertyMappings = d.datasetDefinition.IncomingMappingConfig.PropertyMappings
+	}
+	children := incomingChildTables(d.datasetDefinition, d.db.conf.Schema)
+	if len(children) > 0 && len(keyColumns) != 1 {
+		return nil, common.Err(fmt.Errorf("child tables need a single key column"), common.LayerErrorBadParameter)
 	}
-	propertyMappings := d.datasetDefinition.IncomingMappingConfig.PropertyMappings
 	sinceColumn, _ := d.datasetDefinition.SourceConfig[SinceColumn].(string)
 	sincePrecision, _ := d.datasetDefinition.SourceConfig[SincePrecision].(string)
+	statementLimit := 0
+	if d.db.maxPacket > 0 {
+		statementLimit = d.db.maxPacket - statementOverhead
+	}
+	flushBytes := statementLimit
+	if flushBytesOverride, ok := d.datasetDefinition.SourceConfig[FlushBytes].(float64); ok {
+		flushBytes = int(flushBytesOverride)
+	}
+	deadLetterTable := ""
+	if name := getConfigProperty(d.datasetDefinition.SourceConfig, DeadLetterTable); name != "" {
+		deadLetterTable = quoteTable(d.db.conf.Schema, name)
+	}
 
 	return &MysqlWriter{
 		logger:           d.logger,
 		mapper:           mapper,
 		sinceColumn:      sinceColumn,
 		sincePrecision:   sincePrecision,
+		recordedColumn:   getConfigProperty(d.datasetDefinition.SourceConfig, RecordedColumn),
+		entityColumn:     getConfigProperty(d.datasetDefinition.SourceConfig, EntityColumn),
 		db:               db,
 		ctx:              ctx,
-		table:            tableName,
+		table:            table,
 		flushThreshold:   flushThreshold,
+		flushBytes:       flushBytes,
+		statementLimit:   statementLimit,
 		propertyMappings: propertyMappings,
 		appendMode:       d.datasetDefinition.SourceConfig[AppendMode] == true,
 		idColumn:         idColumn,
+		identityPattern:  identityPattern,
+		keyColumns:       keyColumns,
+		children:         children,
+		columnCase:       columnCase(d.datasetDefinition),
+		transactionScope: transactionScope(d.datasetDefinition),
+		retry:            newRetryConfig(d.datasetDefinition),
+		deadLetterTable:  deadLetterTable,
+		metrics:          d.metrics,
+		dataset:          d.Name(),
 		batchInserts:     make(map[string]EntityInsert),
+		batchRecorded:    make(map[string]uint64),
 	}, nil
 }
 
 type MysqlWriter struct {
+	pool             *MysqlDB
 	logger           common.Logger
 	ctx              context.Context
 	mapper           *common.Mapper
 	db               *sql.DB
 	tx               *sql.Tx
-	table            string
+	table            string // empty if the dataset only routes entities to other tables
+	routes           []*route
 	idColumn         string
+	identityPattern  *regexp.Regexp
+	keyColumns       []string
+	children         []childTable
+	columnCase       string
+	transactionScope string
+	retry            retryConfig
+	// statements already executed in the open transaction
+	journal          []statement
+	deadLetterTable  string
+	failed           int
+	metrics          common.Metrics
+	dataset          string
 	sinceColumn      string
 	sincePrecision   string
+	recordedColumn   string
+	entityColumn     string
 	batchInserts     map[string]EntityInsert
-	deleteIds        []string
+	batchRecorded    map[string]uint64 // newest recorded value per id in the batch
+	deleteKeys       []rowKey
 	batchSize        int
+	batchBytes       int
+	flushBytes       int
+	statementLimit   int // 0 if statements are not limited in size
 	flushThreshold   int
 	appendMode       bool
 	propertyMappings []*common.EntityToItemPropertyMapping
 }
 
 type EntityInsert struct {
-	Id           string
-	Recorded     uint64
-	RowItem      *RowItem
-	InsertString string
+	Id       string
+	Key      rowKey
+	Recorded uint64
+	RowItem  *RowItem
+	Entity   *egdm.Entity
+	// list items of the child table properties
+	Children map[string][]any
 }
 
 func (o *MysqlWriter) Write(entity *egdm.Entity) common.LayerError {
+	targets := o.targets(entity)
+	if len(targets) == 0 {
+		o.abort()
+		return common.Err(fmt.Errorf("entity %s matches no route and dataset %s has no table of its own", entity.ID, o.dataset), common.LayerErrorBadParameter)
+	}
+	for _, target := range targets {
+		if lerr := target.add(entity); lerr != nil {
+			o.abort()
+			return lerr
+		}
+	}
+	// the entity may have been routed to another table before its type or properties changed
+	for _, w := range o.writers() {
+		if slices.Contains(targets, w) {
+			continue
+		}
+		if lerr := w.remove(entity); lerr != nil {
+			o.abort()
+			return lerr
+		}
+	}
+
+	batchSize, batchBytes := o.pending()
+	if batchSize >= o.flushThreshold || (o.flushBytes > 0 && batchBytes >= o.flushBytes) {
+		err := o.flush()
+		if err != nil {
+			o.release()
+			return common.Err(err, common.LayerErrorInternal)
+		}
+		if o.transactionScope == TransactionScopeFlush {
+			// commit each chunk on its own and continue in a new transaction
+			err = o.commit()
+			if err == nil {
+				err = o.begin()
+			}
+			if err != nil {
+				o.abort()
+				return common.Err(err, common.LayerErrorInternal)
+			}
+		}
+		for _, w := range o.writers() {
+			w.reset()
+		}
+	}
+	return nil
+}
+
+// add maps an entity to a row of the writer's table and adds it to the batch.
+func (o *MysqlWriter) add(entity *egdm.Entity) common.LayerError {
 	item := &RowItem{Map: map[string]any{}}
 	err := o.mapper.MapEntityToItem(entity, item)
+	if err == nil {
+		err = o.splitIdentity(item)
+	}
 	if err != nil {
 		return common.Err(err, common.LayerErrorInternal)
 	}
+	children, err := o.extractChildren(item)
+	if err != nil {
+		return common.Err(fmt.Errorf("entity %s: %w", entity.ID, err), common.LayerErrorBadParameter)
+	}
+	if o.entityColumn != "" {
+		// store the whole entity, so it can be read back through the entity column
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return common.Err(fmt.Errorf("entity %s cannot be encoded as json: %w", entity.ID, err), common.LayerErrorBadParameter)
+		}
+		item.SetValue(o.entityColumn, string(data))
+	}
+	err = o.convertRow(item)
+	if err != nil {
+		return common.Err(fmt.Errorf("entity %s: %w", entity.ID, err), common.LayerErrorBadParameter)
+	}
 	// set the deleted flag, we always need this to do the right thing in upsert mode
 	item.deleted = entity.IsDeleted
 
-	// add id to list of ids to delete (even the ones that will be inserted after)
-	found := false
-	for _, id := range o.deleteIds {
-		if id == item.Map[o.idColumn].(string) {
-			found = true
-			break
-		}
+	key, err := o.rowKey(item)
+	if err != nil {
+		return common.Err(fmt.Errorf("entity %s: %w", entity.ID, err), common.LayerErrorBadParameter)
 	}
+
+	// add key to list of keys to delete (even the ones that will be inserted after)
+	recorded, found := o.batchRecorded[key.id]
 	if !found {
-		o.deleteIds = append(o.deleteIds, item.Map[o.idColumn].(string))
+		o.deleteKeys = append(o.deleteKeys, key)
+	}
+	if !found || entity.Recorded > recorded {
+		o.batchRecorded[key.id] = entity.Recorded
 	}
 
-	// if the entity is deleted continue
-	if entity.IsDeleted {
+	// a deleted entity removes its row, unless the row is kept as a tombstone with its recorded
+	// value, so that an older version delivered later is skipped
+	if entity.IsDeleted && o.recordedColumn == "" {
 		o.batchSize++
+		o.batchBytes += keySize(key)
+		// a newer delete wins over an insert of the same key earlier in the batch
+		if existing, exists := o.batchInserts[key.id]; exists && entity.Recorded >= existing.Recorded {
+			delete(o.batchInserts, key.id)
+		}
 	} else {
+		if entity.IsDeleted {
+			children = nil
+		}
 		doInsert := false
-		existing, exists := o.batchInserts[item.Map[o.idColumn].(string)]
-		if exists {
-			// already in batch, check which one is newer
-			if entity.Recorded >= existing.Recorded {
-				// replace existing with newer version
-				o.batchInserts[item.Map[o.idColumn].(string)] = EntityInsert{
-					Id:       item.Map[o.idColumn].(string),
-					Recorded: entity.Recorded,
-					RowItem:  item,
-				}
-				doInsert = true
-			}
-		} else {
-			o.batchInserts[item.Map[o.idColumn].(string)] = EntityInsert{
-				Id:       item.Map[o.idColumn].(string),
+		existing, exists := o.batchInserts[key.id]
+		// if already in batch, only replace it with a newer version
+		if !exists || entity.Recorded >= existing.Recorded {
+			o.batchInserts[key.id] = EntityInsert{
+				Id:       key.id,
+				Key:      key,
 				Recorded: entity.Recorded,
 				RowItem:  item,
+				Entity:   entity,
+				Children: children,
 			}
 			doInsert = true
 		}
 		if doInsert {
-			err = o.insert(o.batchInserts[item.Map[o.idColumn].(string)].RowItem)
+			err = o.insert(key, item, children)
 			if err != nil {
 				return common.Err(err, common.LayerErrorInternal)
 			}
 		}
 	}
+	return nil
+}
 
-	if o.batchSize >= o.flushThreshold {
-		err = o.flush()
-		if err != nil {
-			return common.Err(err, common.LayerErrorInternal)
+// remove deletes the row of an entity from the writer's table without keeping a tombstone,
+// because the entity is written to another table of the dataset. The key joins the deletes of
+// the batch, which run as one chunked statement per table and flush. Removals do not count
+// towards the flush threshold, since most entities never had a row in the table.
+func (o *MysqlWriter) remove(entity *egdm.Entity) common.LayerError {
+	item := &RowItem{Map: map[string]any{}}
+	err := o.mapper.MapEntityToItem(entity, item)
+	if err == nil {
+		err = o.splitIdentity(item)
+	}
+	if err != nil {
+		return common.Err(fmt.Errorf("entity %s cannot be removed from %s: %w", entity.ID, o.table, err), common.LayerErrorInternal)
+	}
+	key, err := o.rowKey(item)
+	if err == nil {
+		for i, col := range o.keyColumns {
+			if key.values[i], err = convertValue(key.values[i], o.mapping(col)); err != nil {
+				break
+			}
 		}
-		o.batchSize = 0
-		o.batchInserts = make(map[string]EntityInsert)
-		o.deleteIds = []string{}
+	}
+	if err != nil {
+		return common.Err(fmt.Errorf("entity %s cannot be removed from %s: %w", entity.ID, o.table, err), common.LayerErrorBadParameter)
+	}
+
+	recorded, found := o.batchRecorded[key.id]
+	if !found {
+		o.deleteKeys = append(o.deleteKeys, key)
+	}
+	if !found || entity.Recorded > recorded {
+		o.batchRecorded[key.id] = entity.Recorded
+	}
+	if existing, exists := o.batchInserts[key.id]; exists && entity.Recorded >= existing.Recorded {
+		delete(o.batchInserts, key.id)
 	}
 	return nil
 }
 
+// pending returns the number of rows and the estimated bytes batched for the writer's table
+// and the tables of its routes.
+func (o *MysqlWriter) pending() (int, int) {
+	size, bytes := 0, 0
+	for _, w := range o.writers() {
+		size += w.batchSize
+		bytes += w.batchBytes
+	}
+	return size, bytes
+}
+
+// reset empties the batch after a flush.
+func (o *MysqlWriter) reset() {
+	o.batchSize = 0
+	o.batchBytes = 0
+	o.batchInserts = make(map[string]EntityInsert)
+	o.batchRecorded = make(map[string]uint64)
+	o.deleteKeys = nil
+}
+
 func (o *MysqlWriter) Close() common.LayerError {
+	defer o.release()
 	err := o.flush()
 	if err != nil {
 		return common.Err(err, common.LayerErrorInternal)
 	}
+	err = o.commit()
+	if err != nil {
+		return common.Err(err, common.LayerErrorInternal)
+	}
+	// the rest of the request is committed, failing it now would make the caller retry and
+	// dead-letter the same entities again. The count is reported through Failed and the metric.
+	if failed := o.Failed(); failed > 0 {
+		o.logger.Warn("entities written to dead letter table", "dataset", o.dataset, "table", o.deadLetterTable, "count", failed)
+	}
+
+	return nil
+}
+
+// Failed returns the number of entities written to the dead letter table instead of the dataset table.
+func (o *MysqlWriter) Failed() int {
+	failed := o.failed
+	for _, r := range o.routes {
+		failed += r.writer.failed
+	}
+	return failed
+}
+
+func (o *MysqlWriter) commit() error {
+	if o.tx == nil {
+		return nil
+	}
+	err := o.tx.Commit()
+	o.tx = nil
+	o.shareTx()
+	o.journal = nil
+	if err != nil {
+		return err
+	}
+	o.logger.Debug("Transaction committed")
+	return nil
+}
+
+// abort rolls back the open transaction and releases the pool. The web layer does not close
+// writers after a failed Write, so this is the last chance to clean up.
+func (o *MysqlWriter) abort() {
 	if o.tx != nil {
-		err = o.tx.Commit()
-		if err != nil {
-			return common.Err(err, common.LayerErrorInternal)
+		if err := o.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			o.logger.Error("Failed to rollback transaction", "error", err)
 		}
-		o.logger.Debug("Transaction committed")
 	}
+	o.release()
+}
 
-	return nil
+func (o *MysqlWriter) release() {
+	if o.pool != nil {
+		o.pool.release()
+		o.pool = nil
+	}
 }
 
-func (o *MysqlWriter) sqlVal(v any, colName string) string {
-	switch v.(type) {
-	case string:
-		for i, _ := range o.propertyMappings {
-			if o.propertyMappings[i].Property == colName {
-				if o.propertyMappings[i].Datatype == "datetime" {
-					t, err := time.Parse(time.RFC3339, v.(string))
-					if err != nil {
-						return "NULL" // or handle the error as needed
-					}
-					v = t.Format("2006-01-02 15:04:05")
-					return fmt.Sprintf("'%s'", v)
-				} else if o.propertyMappings[i].Datatype == "timestamp" {
-					t, err := time.Parse(time.RFC3339, v.(string))
-					if err != nil {
-						return "NULL" // or handle the error as needed
-					}
-					v = t.Format("2006-01-02 15:04:05-0700")
-					return fmt.Sprintf("'%s'", v)
-				}
-			}
+// mapping returns the incoming property mapping of a column, or nil if it has none.
+func (o *MysqlWriter) mapping(colName string) *common.EntityToItemPropertyMapping {
+	for _, pm := range o.propertyMappings {
+		if pm.Property == colName {
+			return pm
 		}
-		return fmt.Sprintf("'%s'", v)
-	case nil:
-		return "NULL"
-	case bool:
-		return fmt.Sprintf("'%t'", v)
-	default:
-		return fmt.Sprintf("%v", v)
 	}
+	return nil
 }
 
+// flush writes the current batch in the writer's transaction. Deletes run first, then inserts
+// as multi-row statements per distinct column list, split where they would exceed
+// max_allowed_packet.
 func (o *MysqlWriter) flush() error {
-	if o.batchSize == 0 {
+	if size, _ := o.pending(); size == 0 {
 		return nil
 	}
-	// execute the delete first
-	if len(o.deleteIds) > 0 {
-		var deleteStatement strings.Builder
-		deleteStatement.WriteString("DELETE FROM ")
-		deleteStatement.WriteString(o.table)
-		deleteStatement.WriteString(" WHERE ")
-		deleteStatement.WriteString(o.idColumn)
-		deleteStatement.WriteString(" IN (")
-		for i, id := range o.deleteIds {
-			if i > 0 {
-				deleteStatement.WriteString(", ")
-			}
-			deleteStatement.WriteString(o.sqlVal(id, "id"))
+
+	writers := o.writers()
+	failed := make([]int, len(writers))
+	for i, w := range writers {
+		failed[i] = w.failed
+	}
+	before := o.Failed()
+	var executed []statement
+	for attempt := 1; ; attempt++ {
+		var err error
+		executed, err = o.execBatches(writers)
+		if err == nil {
+			break
+		}
+		if !isRetryable(err) || attempt > o.retry.attempts {
+			return o.rollback(err)
+		}
+		// rows dead-lettered by the failed attempt are found again by the next one
+		for i, w := range writers {
+			w.failed = failed[i]
 		}
-		deleteStatement.WriteString(");")
+		err = o.restart(attempt, err)
+		if err != nil {
+			return o.rollback(err)
+		}
+	}
+	if after := o.Failed(); after > before && o.metrics != nil {
+		err := o.metrics.Incr("mysql.write.dead_letter", []string{"dataset:" + o.dataset}, after-before)
+		if err != nil {
+			o.logger.Warn("failed to record metric", "error", err)
+		}
+	}
 
-		deltxn := "BEGIN;\n\n" + deleteStatement.String() + "\nCOMMIT;"
-		o.logger.Debug(deltxn)
-		_, err := o.tx.ExecContext(o.ctx, deltxn)
+	// remember what ran in the open transaction, so a retry can replay it
+	if o.tx != nil {
+		o.journal = append(o.journal, executed...)
+	}
+	return nil
+}
+
+// execBatches runs the batches of the given writers, all in the transaction of this writer,
+// and returns the statements that ran.
+func (o *MysqlWriter) execBatches(writers []*MysqlWriter) ([]statement, error) {
+	var executed []statement
+	for _, w := range writers {
+		if w.batchSize == 0 && len(w.deleteKeys) == 0 {
+			continue
+		}
+		statements, err := w.batchStatements()
 		if err != nil {
-			if o.tx != nil {
-				err2 := o.tx.Rollback()
-				if err2 != nil {
-					o.logger.Error("Failed to rollback transaction")
-					return fmt.Errorf("failed to rollback transaction: %w, underlying: %w", err2, err)
-				}
-				o.logger.Debug("Delete transaction rolled back")
+			return executed, err
+		}
+		ran, err := w.execBatch(statements)
+		executed = append(executed, ran...)
+		if err != nil {
+			return executed, err
+		}
+	}
+	return executed, nil
+}
+
+// batchStatements builds the statements for the current batch, leaving out entities that are
+// older than the stored rows when a recorded column is configured.
+func (o *MysqlWriter) batchStatements() ([]statement, error) {
+	stale, err := o.staleIds()
+	if err != nil {
+		return nil, err
+	}
+	keys := o.deleteKeys
+	if len(stale) > 0 {
+		keys = make([]rowKey, 0, len(o.deleteKeys))
+		for _, key := range o.deleteKeys {
+			if !stale[key.id] {
+				keys = append(keys, key)
 			}
-			return err
 		}
 	}
 
-	if len(o.batchInserts) == 0 {
-		return nil
+	// execute the delete first
+	var statements []statement
+	if len(keys) > 0 {
+		for _, chunk := range o.chunkKeys(keys) {
+			stmt, args := o.deleteStatement(chunk)
+			statements = append(statements, statement{stmt: stmt, args: args})
+		}
 	}
-	var insertStatement strings.Builder
-	for _, insert := range o.batchInserts {
-		if len(insertStatement.String()) > 0 {
-			insertStatement.WriteString(";\n")
+	statements = append(statements, o.childDeleteStatements(keys)...)
+	return append(statements, o.insertStatements(stale)...), nil
+}
+
+func (o *MysqlWriter) execAll(statements []statement) error {
+	for _, st := range statements {
+		err := o.exec(st.stmt, st.args)
+		if err != nil {
+			return err
 		}
-		insertStatement.WriteString(insert.InsertString)
 	}
+	return nil
+}
 
-	stmt := "BEGIN;\n\n" + insertStatement.String() + ";\nCOMMIT;"
+// exec runs a statement in the writer's transaction, or in autocommit mode when the
+// transaction scope is none.
+func (o *MysqlWriter) exec(stmt string, args []any) error {
 	o.logger.Debug(stmt)
+	var err error
+	if o.tx != nil {
+		_, err = o.tx.ExecContext(o.ctx, stmt, args...)
+	} else {
+		_, err = o.db.ExecContext(o.ctx, stmt, args...)
+	}
+	return err
+}
 
-	_, err := o.tx.ExecContext(o.ctx, stmt)
-	if err != nil {
-		if o.tx != nil {
-			err2 := o.tx.Rollback()
-			if err2 != nil {
-				o.logger.Error("Failed to rollback transaction")
-				return fmt.Errorf("failed to rollback transaction: %w, underlying: %w", err2, err)
-			}
-			o.logger.Debug("Transaction rolled back")
+// rollback rolls back the transaction after err and returns err, or both if the rollback fails
+func (o *MysqlWriter) rollback(err error) error {
+	if o.tx != nil {
+		err2 := o.tx.Rollback()
+		if err2 != nil {
+			o.logger.Error("Failed to rollback transaction")
+			return fmt.Errorf("failed to rollback transaction: %w, underlying: %w", err2, err)
 		}
-		return err
+		o.logger.Debug("Transaction rolled back")
 	}
+	return err
+}
 
-	return nil
+func (o *MysqlWriter) deleteStatement(keys []rowKey) (string, []any) {
+	match, args := o.keyMatch(keys)
+	return "DELETE FROM " + o.table + " WHERE " + match, args
+}
+
+type statement struct {
+	stmt string
+	args []any
+	// the rows of an insert statement, used to find the offending rows of a failed batch
+	rows []EntityInsert
+	// the child rows of the inserted rows, run right after the insert
+	children []statement
+}
+
+// insertStatements groups the batched rows by their column list, since entities may not
+// map all properties, and builds one multi-row INSERT for each group.
+func (o *MysqlWriter) insertStatements(skip map[string]bool) []statement {
+	ids := make([]string, 0, len(o.batchInserts))
+	for id := range o.batchInserts {
+		if !skip[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var groups []string
+	rowsByColumns := map[string][]EntityInsert{}
+	for _, id := range ids {
+		row := o.batchInserts[id]
+		key := strings.Join(row.RowItem.Columns, "\x00")
+		if _, found := rowsByColumns[key]; !found {
+			groups = append(groups, key)
+		}
+		rowsByColumns[key] = append(rowsByColumns[key], row)
+	}
+
+	statements := make([]statement, 0, len(groups))
+	for _, key := range groups {
+		for _, rows := range o.chunkRows(rowsByColumns[key]) {
+			statements = append(statements, o.insertStatement(rows))
+		}
+	}
+	return statements
 }
-func (o *MysqlWriter) insert(item *RowItem) error {
-	// Always create a new INSERT statement for each item, but batch them together
+
+// insertStatement builds a multi-row INSERT for rows that share the same column list.
+func (o *MysqlWriter) insertStatement(rows []EntityInsert) statement {
+	sincePrecision := o.sincePrecision
+	if sincePrecision == "" {
+		sincePrecision = "6"
+	}
+	columns := rows[0].RowItem.Columns
+
 	var sb strings.Builder
 	sb.WriteString("INSERT INTO ")
 	sb.WriteString(o.table)
 	sb.WriteString(" (")
-
-	for i, col := range item.Columns {
+	for i, col := range columns {
 		if i > 0 {
 			sb.WriteString(", ")
 		}
-		sb.WriteString(strings.ToLower(col))
+		sb.WriteString(quoteIdentifier(applyColumnCase(o.columnCase, col)))
+	}
+	if o.recordedColumn != "" {
+		sb.WriteString(", ")
+		sb.WriteString(quoteIdentifier(applyColumnCase(o.columnCase, o.recordedColumn)))
 	}
-
 	if o.sinceColumn != "" {
 		sb.WriteString(", ")
-		sb.WriteString(strings.ToLower(o.sinceColumn))
+		sb.WriteString(quoteIdentifier(applyColumnCase(o.columnCase, o.sinceColumn)))
 	}
+	sb.WriteString(") VALUES ")
 
-	sb.WriteString(") VALUES (")
-
-	for i, val := range item.Values {
-		colName := item.Columns[i]
-		if i > 0 {
+	args := make([]any, 0, len(rows)*len(columns))
+	for r, row := range rows {
+		item := row.RowItem
+		if r > 0 {
 			sb.WriteString(", ")
 		}
-		sb.WriteString(o.sqlVal(val, colName))
-	}
-
-	var sincePrecision string
-	if o.sincePrecision != "" {
-		sincePrecision = o.sincePrecision
-	} else {
-		sincePrecision = "6"
-	}
-	if o.sinceColumn != "" {
-		sb.WriteString(", NOW(")
-		sb.WriteString(sincePrecision)
+		sb.WriteString("(")
+		for i, val := range item.Values {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("?")
+			args = append(args, val)
+		}
+		if o.recordedColumn != "" {
+			sb.WriteString(", ?")
+			args = append(args, row.Recorded)
+		}
+		if o.sinceColumn != "" {
+			sb.WriteString(", NOW(")
+			sb.WriteString(sincePrecision)
+			sb.WriteString(")")
+		}
 		sb.WriteString(")")
 	}
+	return statement{stmt: sb.String(), args: args, rows: rows, children: o.childInsertStatements(rows)}
+}
 
-	sb.WriteString(")")
-
-	batchInsert := o.batchInserts[item.Map[o.idColumn].(string)]
-	batchInsert.InsertString = sb.String()
-	o.batchInserts[item.Map[o.idColumn].(string)] = batchInsert
-
+func (o *MysqlWriter) insert(key rowKey, item *RowItem, children map[string][]any) error {
+	// rows are collected in batchInserts and written as one statement per column list on flush
+	size := o.rowSize(item) + childSize(children)
+	if err := o.checkRowSize(key.id, size); err != nil {
+		return err
+	}
 	o.batchSize++
+	o.batchBytes += size
 	return nil
 }
 
@@ -379,11 +757,16 @@ func (o *MysqlWriter) insert(item *RowItem) error {
 }*/
 
 func (o *MysqlWriter) begin() error {
+	if o.transactionScope == TransactionScopeNone {
+		// no transaction, but make sure the pool is usable before accepting entities
+		return o.db.PingContext(o.ctx)
+	}
 	tx, err := o.db.Begin()
 	if err != nil {
 		return err
 	}
 	o.tx = tx
+	o.shareTx()
 	o.logger.Debug("Transaction started")
 	return nil
 }
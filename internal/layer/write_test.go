@@ -0,0 +1,259 @@
+package layer
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func newTestWriter() *MysqlWriter {
+	return &MysqlWriter{
+		logger:       common.NewLogger("test", "text", "error"),
+		table:        "`product`",
+		idColumn:     "id",
+		keyColumns:   []string{"id"},
+		sinceColumn:  "updated",
+		batchInserts: map[string]EntityInsert{},
+		propertyMappings: []*common.EntityToItemPropertyMapping{
+			{Property: "date", Datatype: "datetime"},
+		},
+	}
+}
+
+func testRow(columns []string, values []any) *RowItem {
+	item := &RowItem{Map: map[string]any{}}
+	for i, col := range columns {
+		item.SetValue(col, values[i])
+	}
+	return item
+}
+
+func TestWriterStatements(t *testing.T) {
+	t.Run("Should build one parameterized delete statement", func(t *testing.T) {
+		w := newTestWriter()
+		w.deleteKeys = []rowKey{newRowKey([]any{"1"}), newRowKey([]any{"2'; DROP TABLE product; --"})}
+		stmt, args := w.deleteStatement(w.deleteKeys)
+		if stmt != "DELETE FROM `product` WHERE `id` IN (?, ?)" {
+			t.Fatalf("Unexpected statement %s", stmt)
+		}
+		if len(args) != 2 || args[1] != "2'; DROP TABLE product; --" {
+			t.Fatalf("Unexpected args %v", args)
+		}
+	})
+
+	t.Run("Should group inserts by column list", func(t *testing.T) {
+		w := newTestWriter()
+		w.batchInserts["1"] = EntityInsert{Id: "1", RowItem: testRow([]string{"id", "date"}, []any{"1", "2024-01-02T03:04:05Z"})}
+		w.batchInserts["2"] = EntityInsert{Id: "2", RowItem: testRow([]string{"id"}, []any{"2"})}
+		w.batchInserts["3"] = EntityInsert{Id: "3", RowItem: testRow([]string{"id", "date"}, []any{"3", nil})}
+		for _, row := range w.batchInserts {
+			if err := w.convertRow(row.RowItem); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		statements := w.insertStatements(nil)
+		if len(statements) != 2 {
+			t.Fatalf("Expected 2 statements, got %d", len(statements))
+		}
+		if statements[0].stmt != "INSERT INTO `product` (`id`, `date`, `updated`) VALUES (?, ?, NOW(6)), (?, ?, NOW(6))" {
+			t.Fatalf("Unexpected statement %s", statements[0].stmt)
+		}
+		if !reflect.DeepEqual(statements[0].args, []any{"1", "2024-01-02 03:04:05", "3", nil}) {
+			t.Fatalf("Unexpected args %v", statements[0].args)
+		}
+		if !strings.HasPrefix(statements[1].stmt, "INSERT INTO `product` (`id`, `updated`) VALUES (?, NOW(6))") {
+			t.Fatalf("Unexpected statement %s", statements[1].stmt)
+		}
+	})
+}
+
+func TestRetryConfig(t *testing.T) {
+	t.Run("Should use defaults and overrides from source config", func(t *testing.T) {
+		rc := newRetryConfig(&common.DatasetDefinition{SourceConfig: map[string]any{}})
+		if rc.attempts != defaultRetryAttempts || rc.backoff != defaultRetryBackoff {
+			t.Fatalf("Unexpected defaults %+v", rc)
+		}
+		rc = newRetryConfig(&common.DatasetDefinition{SourceConfig: map[string]any{RetryAttempts: 5.0, RetryBackoff: "1s"}})
+		if rc.attempts != 5 || rc.backoff.String() != "1s" {
+			t.Fatalf("Unexpected config %+v", rc)
+		}
+	})
+
+	t.Run("Should only retry deadlocks and lock wait timeouts", func(t *testing.T) {
+		if !isRetryable(&mysql.MySQLError{Number: 1213}) || !isRetryable(&mysql.MySQLError{Number: 1205}) {
+			t.Fatalf("Expected deadlock and lock wait timeout to be retryable")
+		}
+		if isRetryable(&mysql.MySQLError{Number: 1406}) {
+			t.Fatalf("Expected data too long not to be retryable")
+		}
+	})
+}
+
+func TestDeadLetter(t *testing.T) {
+	t.Run("Should only bisect batches failing with data errors", func(t *testing.T) {
+		if !isDataError(&mysql.MySQLError{Number: 1406}) {
+			t.Fatalf("Expected data too long to be a data error")
+		}
+		if isDataError(&mysql.MySQLError{Number: 1213}) || isDataError(errors.New("connection reset")) {
+			t.Fatalf("Expected deadlocks and other errors not to be data errors")
+		}
+	})
+
+	t.Run("Should report dead-lettered entities without failing the request", func(t *testing.T) {
+		w := newTestWriter()
+		w.dataset = "products"
+		w.deadLetterTable = "`failed`"
+		w.failed = 2
+		if err := w.Close(); err != nil {
+			t.Fatalf("Expected no error after the rest of the request was committed, got %v", err)
+		}
+		if w.Failed() != 2 {
+			t.Fatalf("Expected 2 failed entities, got %d", w.Failed())
+		}
+	})
+
+	t.Run("Should build dead letter rows with the entity json", func(t *testing.T) {
+		w := newTestWriter()
+		w.dataset = "products"
+		w.deadLetterTable = "`failed`"
+		entity := egdm.NewEntity().SetID("http://data.test/1")
+		st := w.deadLetterStatement(EntityInsert{Id: "1", Entity: entity}, &mysql.MySQLError{Number: 1406, Message: "Data too long for column 'name' at row 1"})
+		if st.stmt != "INSERT INTO `failed` (`dataset`, `entity_id`, `error`, `entity`, `failed_at`) VALUES (?, ?, ?, ?, NOW(6))" {
+			t.Fatalf("Unexpected statement %s", st.stmt)
+		}
+		if st.args[0] != "products" || st.args[1] != "1" || !strings.Contains(st.args[2].(string), "Data too long") {
+			t.Fatalf("Unexpected args %v", st.args)
+		}
+		if !strings.Contains(st.args[3].(string), `"id":"http://data.test/1"`) {
+			t.Fatalf("Expected entity json, got %v", st.args[3])
+		}
+	})
+}
+
+func TestStatementLimit(t *testing.T) {
+	t.Run("Should split inserts and deletes that would exceed the statement limit", func(t *testing.T) {
+		w := newTestWriter()
+		for _, id := range []string{"1", "2", "3", "4"} {
+			w.batchInserts[id] = EntityInsert{Id: id, RowItem: testRow([]string{"id", "name"}, []any{id, strings.Repeat("x", 100)})}
+			w.deleteKeys = append(w.deleteKeys, newRowKey([]any{id}))
+		}
+		w.statementLimit = 2*w.rowSize(w.batchInserts["1"].RowItem) + 1
+
+		statements := w.insertStatements(nil)
+		if len(statements) != 2 || len(statements[0].rows) != 2 || len(statements[1].rows) != 2 {
+			t.Fatalf("Expected 2 statements of 2 rows, got %d", len(statements))
+		}
+		if chunks := w.chunkKeys(w.deleteKeys); len(chunks) != 1 {
+			t.Fatalf("Expected short ids in one delete, got %d", len(chunks))
+		}
+		w.statementLimit = 2 * keySize(newRowKey([]any{"1"}))
+		if chunks := w.chunkKeys(w.deleteKeys); len(chunks) != 2 {
+			t.Fatalf("Expected 2 deletes, got %d", len(chunks))
+		}
+	})
+
+	t.Run("Should reject rows larger than the statement limit", func(t *testing.T) {
+		w := newTestWriter()
+		w.statementLimit = 100
+		row := testRow([]string{"id", "name"}, []any{"1", strings.Repeat("x", 100)})
+		if err := w.checkRowSize("1", w.rowSize(row)); err == nil {
+			t.Fatalf("Expected an error for a row larger than the limit")
+		}
+		w.statementLimit = 0
+		if err := w.checkRowSize("1", w.rowSize(row)); err != nil {
+			t.Fatalf("Expected no limit, got %v", err)
+		}
+	})
+}
+
+func TestRecordedColumn(t *testing.T) {
+	t.Run("Should store the recorded value with each row", func(t *testing.T) {
+		w := newTestWriter()
+		w.recordedColumn = "recorded"
+		w.batchInserts["1"] = EntityInsert{Id: "1", Recorded: 42, RowItem: testRow([]string{"id"}, []any{"1"})}
+		w.batchInserts["2"] = EntityInsert{Id: "2", Recorded: 43, RowItem: testRow([]string{"id"}, []any{"2"})}
+
+		statements := w.insertStatements(map[string]bool{"2": true})
+		if len(statements) != 1 {
+			t.Fatalf("Expected 1 statement, got %d", len(statements))
+		}
+		if statements[0].stmt != "INSERT INTO `product` (`id`, `recorded`, `updated`) VALUES (?, ?, NOW(6))" {
+			t.Fatalf("Unexpected statement %s", statements[0].stmt)
+		}
+		if !reflect.DeepEqual(statements[0].args, []any{"1", uint64(42)}) {
+			t.Fatalf("Unexpected args %v", statements[0].args)
+		}
+	})
+
+	t.Run("Should keep deleted entities as rows with their recorded value", func(t *testing.T) {
+		w := newKeyTestWriter(t, map[string]any{})
+		w.recordedColumn = "recorded"
+		w.mapper = common.NewMapper(w.logger, &common.IncomingMappingConfig{
+			BaseURI: "http://data.test/",
+			PropertyMappings: []*common.EntityToItemPropertyMapping{
+				{Property: "id", IsIdentity: true, StripReferencePrefix: true},
+				{Property: "deleted", IsDeleted: true},
+			},
+		}, nil)
+		deleted := egdm.NewEntity().SetID("http://data.test/1")
+		deleted.IsDeleted = true
+		deleted.Recorded = 5
+		if err := w.Write(deleted); err != nil {
+			t.Fatal(err)
+		}
+		row, found := w.batchInserts["1"]
+		if !found || row.Recorded != 5 || !reflect.DeepEqual(row.RowItem.Values, []any{"1", 1}) {
+			t.Fatalf("Expected a tombstone row, got %+v", row.RowItem)
+		}
+		if len(w.deleteKeys) != 1 {
+			t.Fatalf("Expected the stored row to be replaced, got %v", w.deleteKeys)
+		}
+	})
+
+	t.Run("Should lock the stored recorded values of the batch", func(t *testing.T) {
+		w := newTestWriter()
+		w.recordedColumn = "recorded"
+		stmt, args := w.recordedStatement([]rowKey{newRowKey([]any{"1"}), newRowKey([]any{"2"})})
+		if stmt != "SELECT CASE WHEN `id` = ? THEN ? WHEN `id` = ? THEN ? END, `recorded` FROM `product` WHERE `id` IN (?, ?) FOR UPDATE" {
+			t.Fatalf("Unexpected statement %s", stmt)
+		}
+		if !reflect.DeepEqual(args, []any{"1", "1", "2", "2", "1", "2"}) {
+			t.Fatalf("Unexpected args %v", args)
+		}
+	})
+
+	t.Run("Should let the database match composite keys of any type to the batch ids", func(t *testing.T) {
+		w := newTestWriter()
+		w.recordedColumn = "recorded"
+		w.keyColumns = []string{"code", "valid_from"}
+		validFrom := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		key := newRowKey([]any{"ABC", validFrom})
+		stmt, args := w.recordedStatement([]rowKey{key})
+		if stmt != "SELECT CASE WHEN (`code`, `valid_from`) = (?, ?) THEN ? END, `recorded` FROM `product` WHERE (`code`, `valid_from`) IN ((?, ?)) FOR UPDATE" {
+			t.Fatalf("Unexpected statement %s", stmt)
+		}
+		if !reflect.DeepEqual(args, []any{"ABC", validFrom, key.id, "ABC", validFrom}) {
+			t.Fatalf("Unexpected args %v", args)
+		}
+	})
+
+	t.Run("Should size recorded statement chunks for the doubled key values", func(t *testing.T) {
+		w := newTestWriter()
+		w.recordedColumn = "recorded"
+		keys := []rowKey{newRowKey([]any{"1"}), newRowKey([]any{"2"})}
+		w.statementLimit = keySize(keys[0]) * 2
+		if chunks := w.chunkKeys(keys); len(chunks) != 1 {
+			t.Fatalf("Expected the delete keys to fit one statement, got %d", len(chunks))
+		}
+		if chunks := w.chunkKeysBy(keys, recordedKeySize); len(chunks) != 2 {
+			t.Fatalf("Expected the recorded keys to need two statements, got %d", len(chunks))
+		}
+	})
+}